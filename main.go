@@ -30,11 +30,13 @@ import (
 	"github.com/gusmin/gate/pkg/core"
 	"github.com/gusmin/gate/pkg/database"
 	"github.com/gusmin/gate/pkg/i18n"
+	"github.com/gusmin/gate/pkg/redact"
 	"github.com/gusmin/gate/pkg/shell"
 	"gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/gofrs/flock"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
 var version string
@@ -51,6 +53,11 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	redactor, err := redact.New(cfg.RedactionRules)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
 	repo := database.NewSecureGateBoltRepository(cfg.DBPath)
 	err = repo.OpenDatabase()
 	if err != nil {
@@ -60,7 +67,11 @@ func main() {
 
 	backendClient := backend.NewClient(cfg.BackendURI)
 
-	agentClient := agent.NewClient(cfg.AgentAuthToken, nil)
+	agentHTTPClient, err := agent.NewHTTPClient(cfg.AgentCAFile, cfg.AgentCertFile, cfg.AgentKeyFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	agentClient := agent.NewClient(cfg.AgentAuthToken, agentHTTPClient)
 
 	// Log rotation	to not pollute disk space
 	rotatingLogFile := &lumberjack.Logger{
@@ -81,6 +92,21 @@ func main() {
 
 	translator := i18n.NewTranslatorFromFile(cfg.Language, translationsDir)
 
+	// Machines trust the certificates signed by the gate if it has a CA
+	var ca ssh.Signer
+	if cfg.CAKeyPath != "" {
+		ca, err = core.LoadCertificateAuthority(cfg.CAKeyPath)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	keyStore, err := core.OpenKeyStore(cfg.KeyStore, cfg.KeyStorePath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer keyStore.Close()
+
 	core := core.New(
 		cfg.SSHUser,
 		backendClient,
@@ -89,6 +115,15 @@ func main() {
 		translator,
 		repo,
 	)
+	core.Config = cfg
+	core.Redactor = redactor
+	core.CA = ca
+	core.Keys = keyStore
+	// Revoke the keys of the sessions which never logged out
+	err = core.RevokeStaleEphemeralKeys(context.Background())
+	if err != nil {
+		logrus.Fatal(err)
+	}
 	command := commands.NewSecureGateCommand(core)
 	prompt, err := shell.NewSecureGatePrompt(os.Stdin, core)
 	if err != nil {
@@ -152,6 +187,9 @@ func (hook *writerHook) Fire(entry *logrus.Entry) error {
 		Msg     string    `json:"msg"`
 		Time    time.Time `json:"time"`
 		User    string    `json:"user"`
+		Account string    `json:"account"`
+		Session string    `json:"session"`
+		Event   string    `json:"event"`
 	}{}
 	_ = json.Unmarshal(logEntry, &logObj)
 
@@ -168,6 +206,9 @@ func (hook *writerHook) Fire(entry *logrus.Entry) error {
 			UserID:    logObj.User,
 			MachineID: logObj.Machine,
 			Log:       logObj.Msg,
+			Account:   logObj.Account,
+			SessionID: logObj.Session,
+			Event:     logObj.Event,
 		}
 		res, err := hook.backendClient.AddMachineLog(
 			context.Background(),
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterHook(t *testing.T) {
+	assert := require.New(t)
+
+	requests := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		requests <- string(b)
+		rw.Write([]byte(`{"data": {"addMachineLog": {"success": true}}}`))
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logger.AddHook(&writerHook{
+		writer:        &out,
+		logLevels:     logrus.AllLevels,
+		formatter:     new(logrus.JSONFormatter),
+		backendClient: backend.NewClient(server.URL),
+	})
+
+	logger.WithFields(logrus.Fields{
+		"user":    "foobar",
+		"machine": "nowhere42",
+		"account": "deploy",
+		"session": "1f0c",
+		"event":   "input",
+	}).Warnf("ls -la\n")
+
+	// Every field of the audit trail reaches the backend
+	request := <-requests
+	for _, field := range []string{
+		`"userId":"foobar"`,
+		`"machineId":"nowhere42"`,
+		`"log":"ls -la\n"`,
+		`"account":"deploy"`,
+		`"sessionId":"1f0c"`,
+		`"event":"input"`,
+	} {
+		assert.Contains(request, field)
+	}
+	assert.Contains(out.String(), `"session":"1f0c"`)
+}
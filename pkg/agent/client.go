@@ -41,10 +41,11 @@ type SSHAuthResponse struct {
 }
 
 // AddAuthorizedKey add the public SSH key to the authorized_keys file
-// located on the agent running at the given endpoint for the given user id.
-func (c Client) AddAuthorizedKey(ctx context.Context, endpoint, id string, key []byte) (SSHAuthResponse, error) {
+// located on the agent running at the given endpoint for the given user id,
+// the one of the given remote account if any.
+func (c Client) AddAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (SSHAuthResponse, error) {
 	// Marshal the key as json body.
-	body, err := json.Marshal(map[string]interface{}{"publicKey": strings.TrimSpace(string(key))})
+	body, err := marshalAuthorizedKey(account, key)
 	if err != nil {
 		return SSHAuthResponse{}, errors.Wrap(err, "could not create body for ssh-authorization POST request")
 	}
@@ -74,10 +75,11 @@ func makeAddAuthorizedKeyRequest(endpoint, id, token string, body io.Reader) (*h
 }
 
 // DeleteAuthorizedKey deletes the public SSH key from the authorized_keys file
-// located on the agent running at the given endpoint for the given user id.
-func (c Client) DeleteAuthorizedKey(ctx context.Context, endpoint, id string, key []byte) (SSHAuthResponse, error) {
+// located on the agent running at the given endpoint for the given user id,
+// the one of the given remote account if any.
+func (c Client) DeleteAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (SSHAuthResponse, error) {
 	// Marshal the key as json body.
-	body, err := json.Marshal(map[string]interface{}{"publicKey": strings.TrimSpace(string(key))})
+	body, err := marshalAuthorizedKey(account, key)
 	if err != nil {
 		return SSHAuthResponse{}, errors.Wrap(err, "could not create body for ssh-authorization DELETE request")
 	}
@@ -106,6 +108,15 @@ func makeDeleteSSHPublicKeyRequest(endpoint, id, token string, body io.Reader) (
 	return req, nil
 }
 
+// marshalAuthorizedKey returns the JSON body of ssh-authorization requests.
+func marshalAuthorizedKey(account string, key []byte) ([]byte, error) {
+	body := map[string]interface{}{"publicKey": strings.TrimSpace(string(key))}
+	if account != "" {
+		body["account"] = account
+	}
+	return json.Marshal(body)
+}
+
 func (c Client) do(ctx context.Context, req *http.Request, resp interface{}) error {
 	httpResp, err := c.httpClient.Do(req.WithContext(ctx))
 	if err != nil {
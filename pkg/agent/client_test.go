@@ -43,6 +43,7 @@ func TestAddAuthorizedKey(t *testing.T) {
 	tt := []struct {
 		name         string
 		userID       string
+		account      string
 		key          []byte
 		expectedBody []byte
 		respp        string
@@ -66,6 +67,24 @@ func TestAddAuthorizedKey(t *testing.T) {
 			},
 			err: "",
 		},
+		{
+			name:         "remote account",
+			userID:       "foo",
+			account:      "deploy",
+			key:          []byte("key"),
+			expectedBody: []byte(`{"account":"deploy","publicKey":"key"}`),
+			respp: `
+			{
+				"ErrorType": "NoError",
+				"Message": "all fine"
+			}
+			`,
+			expectedResp: SSHAuthResponse{
+				ErrorType: "NoError",
+				Message:   "all fine",
+			},
+			err: "",
+		},
 		{
 			name:         "emtpy key",
 			userID:       "foo",
@@ -125,7 +144,7 @@ func TestAddAuthorizedKey(t *testing.T) {
 
 			client := NewClient("token", server.Client())
 
-			respp, err := client.AddAuthorizedKey(context.Background(), server.URL, tc.userID, tc.key)
+			respp, err := client.AddAuthorizedKey(context.Background(), server.URL, tc.userID, tc.account, tc.key)
 			if err != nil {
 				assert.Equal(tc.err, errors.Cause(err).Error(),
 					"expected error was: %v, but actual is: %v", tc.err, err)
@@ -143,6 +162,7 @@ func TestDeleteAuthorizedKey(t *testing.T) {
 	tt := []struct {
 		name         string
 		userID       string
+		account      string
 		key          []byte
 		expectedBody []byte
 		resp         string
@@ -166,6 +186,24 @@ func TestDeleteAuthorizedKey(t *testing.T) {
 			},
 			err: "",
 		},
+		{
+			name:         "remote account",
+			userID:       "foo",
+			account:      "deploy",
+			key:          []byte("key"),
+			expectedBody: []byte(`{"account":"deploy","publicKey":"key"}`),
+			resp: `
+			{
+				"ErrorType": "NoError",
+				"Message": "all fine"
+			}
+			`,
+			expectedResp: SSHAuthResponse{
+				ErrorType: "NoError",
+				Message:   "all fine",
+			},
+			err: "",
+		},
 		{
 			name:         "empty key",
 			userID:       "foo",
@@ -225,7 +263,7 @@ func TestDeleteAuthorizedKey(t *testing.T) {
 
 			client := NewClient("token", server.Client())
 
-			respp, err := client.DeleteAuthorizedKey(context.Background(), server.URL, tc.userID, tc.key)
+			respp, err := client.DeleteAuthorizedKey(context.Background(), server.URL, tc.userID, tc.account, tc.key)
 			if err != nil {
 				assert.Equal(tc.err, errors.Cause(err).Error(),
 					"expected error was: %v, but actual is: %v", tc.err, err)
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// NewHTTPClient creates an HTTP client for agents served over HTTPS.
+// Agent certificates are verified with the CA bundle of caFile, or the
+// system roots if empty, and the client certificate of certFile and keyFile
+// is presented to agents requiring mutual TLS, if given.
+// Agents may also be pinned per request with WithCertificatePin.
+func NewHTTPClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read agents CA bundle")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in agents CA bundle %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load agents client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{Transport: &pinningTransport{
+		config:     config,
+		transports: make(map[string]*http.Transport),
+	}}, nil
+}
+
+// pinningTransport sends the requests to agents with a transport of its
+// own for each certificate pin, so that a connection opened to an agent
+// is only reused by requests expecting the certificate it was checked
+// against.
+type pinningTransport struct {
+	config *tls.Config
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport // by pin, "" for unpinned agents
+}
+
+func (t *pinningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pin, _ := req.Context().Value(pinKey{}).(string)
+	return t.transport(pin).RoundTrip(req)
+}
+
+// transport returns the transport of the requests expecting the pin.
+func (t *pinningTransport) transport(pin string) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if transport, ok := t.transports[pin]; ok {
+		return transport
+	}
+
+	config := t.config.Clone()
+	if pin != "" {
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPin(rawCerts, pin)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	t.transports[pin] = transport
+	return transport
+}
+
+// verifyPin checks the certificate presented by the agent against the pin.
+func verifyPin(rawCerts [][]byte, pin string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("agent presented no certificate")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return errors.Wrap(err, "could not parse agent certificate")
+	}
+	if CertificatePin(leaf) != pin {
+		return fmt.Errorf("certificate of agent does not match its pin %s", pin)
+	}
+	return nil
+}
+
+type pinKey struct{}
+
+// WithCertificatePin returns a context requiring the agent to present
+// a certificate of the given pin, as returned by CertificatePin.
+func WithCertificatePin(ctx context.Context, pin string) context.Context {
+	return context.WithValue(ctx, pinKey{}, pin)
+}
+
+// CertificatePin returns the pin of the certificate: the base64 SHA-256
+// hash of its public key prefixed by "sha256/", which remains the same
+// when the certificate is renewed with the same key.
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
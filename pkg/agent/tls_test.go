@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes a self-signed certificate and its key in dir.
+func writeCertificate(t *testing.T, dir, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(t, err)
+
+	certFile = path.Join(dir, name+".crt")
+	keyFile = path.Join(dir, name+".key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile, cert
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "agent")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Agent requiring a client certificate
+	certFile, keyFile, clientCert := writeCertificate(t, dir, "gate")
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ErrorType":"","Message":"ok"}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	server.TLS.ClientCAs.AddCert(clientCert)
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := path.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	assert.NoError(err)
+
+	// Unknown agents are refused
+	httpClient, err := NewHTTPClient("", certFile, keyFile)
+	assert.NoError(err)
+	_, err = NewClient("token", httpClient).AddAuthorizedKey(context.Background(), server.URL, "1", "", []byte("key"))
+	assert.Error(err)
+
+	// Agents require a client certificate
+	httpClient, err = NewHTTPClient(caFile, "", "")
+	assert.NoError(err)
+	_, err = NewClient("token", httpClient).AddAuthorizedKey(context.Background(), server.URL, "1", "", []byte("key"))
+	assert.Error(err)
+
+	httpClient, err = NewHTTPClient(caFile, certFile, keyFile)
+	assert.NoError(err)
+	resp, err := NewClient("token", httpClient).AddAuthorizedKey(context.Background(), server.URL, "1", "", []byte("key"))
+	assert.NoError(err)
+	assert.Equal("ok", resp.Message)
+
+	// Pinned agents must present the pinned certificate,
+	// even on connections kept from previous requests
+	ctx := WithCertificatePin(context.Background(), CertificatePin(clientCert))
+	_, err = NewClient("token", httpClient).AddAuthorizedKey(ctx, server.URL, "1", "", []byte("key"))
+	assert.Error(err)
+	assert.Contains(err.Error(), "does not match its pin")
+
+	ctx = WithCertificatePin(context.Background(), CertificatePin(server.Certificate()))
+	_, err = NewClient("token", httpClient).AddAuthorizedKey(ctx, server.URL, "1", "", []byte("key"))
+	assert.NoError(err)
+	ctx = WithCertificatePin(context.Background(), CertificatePin(clientCert))
+	_, err = NewClient("token", httpClient).AddAuthorizedKey(ctx, server.URL, "1", "", []byte("key"))
+	assert.Error(err)
+
+	// Invalid files
+	_, err = NewHTTPClient(keyFile, "", "")
+	assert.EqualError(err, "no certificate found in agents CA bundle "+keyFile)
+	_, err = NewHTTPClient("", certFile, "")
+	assert.Error(err)
+}
@@ -3,6 +3,7 @@ package backend
 
 import (
 	"context"
+	"time"
 
 	"github.com/gusmin/graphql"
 	"github.com/pkg/errors"
@@ -59,7 +60,24 @@ type Machine struct {
 	Name      string `json:"name"`
 	IP        string `json:"ip"`
 	AgentPort int    `json:"agentPort"`
-}
+	SSHPort   int    `json:"sshPort"`
+	// Remote account the authenticated user logs in as on this machine.
+	// Empty when the gate default one must be used.
+	Account string `json:"account"`
+	// Host keys of the machine in authorized_keys format.
+	// Empty when the backend does not know them.
+	HostKeys []string `json:"hostKeys"`
+	// ID of the machine the SSH connection must go through
+	// to reach this one. Empty when it is directly reachable.
+	Via string `json:"via"`
+	// Scheme of the agent API, "https" or "http".
+	// Empty when the gate configured one must be used.
+	AgentScheme string `json:"agentScheme"`
+}
+
+// DefaultSSHPort is the SSH port of the machines
+// for which the backend does not provide one.
+const DefaultSSHPort = 22
 
 // Machines retrieves all the accessible nodes by the authenticated user.
 func (c *Client) Machines(ctx context.Context) (MachinesResponse, error) {
@@ -68,6 +86,11 @@ func (c *Client) Machines(ctx context.Context) (MachinesResponse, error) {
 	if err != nil {
 		return MachinesResponse{}, errors.Wrap(err, "machines request failed")
 	}
+	for i := range res.Machines {
+		if res.Machines[i].SSHPort == 0 {
+			res.Machines[i].SSHPort = DefaultSSHPort
+		}
+	}
 	return res, nil
 }
 
@@ -83,6 +106,7 @@ type User struct {
 	FirstName string `json:"firstname"`
 	LastName  string `json:"lastname"`
 	Job       string `json:"job"`
+	Role      string `json:"role"`
 }
 
 // Me get informations related to the user.
@@ -113,6 +137,12 @@ type MachineLogInput struct {
 	MachineID string  `json:"machineId"`
 	UserID    string  `json:"userId"`
 	Log       string  `json:"log"`
+	// Remote account the user is logged in as on the machine, if any
+	Account string `json:"account,omitempty"`
+	// ID of the connect session the log belongs to, if any
+	SessionID string `json:"sessionId,omitempty"`
+	// Type of session event logged: "input" or "output", if any
+	Event string `json:"event,omitempty"`
 }
 
 // AddMachineLog sends session's recorded log.
@@ -125,6 +155,54 @@ func (c *Client) AddMachineLog(ctx context.Context, inputs []MachineLogInput) (A
 	return res, nil
 }
 
+// Types of session events.
+const (
+	SessionStarted = "STARTED"
+	SessionEnded   = "ENDED"
+)
+
+// SessionEventInput is the input type required by the server for the
+// beginning or the end of a session on a machine.
+// Timestamps and durations are in milliseconds.
+type SessionEventInput struct {
+	Type      string  `json:"type"`
+	SessionID string  `json:"sessionId"`
+	UserID    string  `json:"userId"`
+	MachineID string  `json:"machineId"`
+	Account   string  `json:"account"`
+	Start     float64 `json:"start"`
+	// Only set when the session ended.
+	End              float64 `json:"end,omitempty"`
+	Duration         float64 `json:"duration,omitempty"`
+	ExitStatus       *int    `json:"exitStatus,omitempty"` // nil when the remote did not exit with a status
+	ExitSignal       string  `json:"exitSignal,omitempty"` // name of the signal which killed the remote if any
+	BytesSent        int64   `json:"bytesSent,omitempty"`
+	BytesReceived    int64   `json:"bytesReceived,omitempty"`
+	DisconnectReason string  `json:"disconnectReason,omitempty"`
+}
+
+// Timestamp returns the time in milliseconds since the Unix epoch,
+// the format of the timestamps expected by the server.
+func Timestamp(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
+
+// AddSessionEventResponse is the response sent by the server
+// after an AddSessionEvent mutation.
+type AddSessionEventResponse struct {
+	AddSessionEvent BaseResult `json:"addSessionEvent"`
+}
+
+// AddSessionEvent sends the beginning or the end of a session.
+func (c *Client) AddSessionEvent(ctx context.Context, input SessionEventInput) (AddSessionEventResponse, error) {
+	var res AddSessionEventResponse
+	err := c.gqlClient.Run(ctx, makeAddSessionEventRequest(c.token, input), &res)
+	if err != nil {
+		return AddSessionEventResponse{}, errors.Wrap(err, "addSessionEvent request failed")
+	}
+	return res, nil
+}
+
 // SetToken set the JWT used for future requests to the given token.
 // What you usually want to do is to set it with the token you received
 // after a successful Auth request.
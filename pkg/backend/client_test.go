@@ -115,7 +115,9 @@ func TestMachines(t *testing.T) {
 						{
 							"name": "localhost",
 							"ip": "127.0.0.1",
-							"agentPort": 3001
+							"agentPort": 3001,
+							"account": "deploy",
+							"via": "bastion"
 						}
 					]
 				}
@@ -127,6 +129,9 @@ func TestMachines(t *testing.T) {
 						Name:      "localhost",
 						IP:        "127.0.0.1",
 						AgentPort: 3001,
+						SSHPort:   22,
+						Account:   "deploy",
+						Via:       "bastion",
 					},
 				},
 			},
@@ -339,3 +344,157 @@ func TestAddMachineLog(t *testing.T) {
 		})
 	}
 }
+
+func TestAddSessionEvent(t *testing.T) {
+	assert := require.New(t)
+
+	status := 130
+	tt := []struct {
+		name           string
+		token          string
+		input          SessionEventInput
+		expectedInputs string
+		resp           string
+		expectedResp   AddSessionEventResponse
+		err            string
+	}{
+		{
+			name:  "session started",
+			token: "token",
+			input: SessionEventInput{
+				Type:      SessionStarted,
+				SessionID: "randomSessionID",
+				UserID:    "randomUserID",
+				MachineID: "randomMachineID",
+				Account:   "deploy",
+				Start:     1337,
+			},
+			expectedInputs: `
+			{
+				"sessionEvent": {
+					"type": "STARTED",
+					"sessionId": "randomSessionID",
+					"userId": "randomUserID",
+					"machineId": "randomMachineID",
+					"account": "deploy",
+					"start": 1337
+				}
+			}
+			`,
+			resp: `
+			{
+				"data": {
+					"addSessionEvent": {
+						"success": true
+					}
+				}
+			}
+			`,
+			expectedResp: AddSessionEventResponse{
+				BaseResult{
+					Success: true,
+				},
+			},
+			err: "",
+		},
+		{
+			name:  "session ended",
+			token: "token",
+			input: SessionEventInput{
+				Type:             SessionEnded,
+				SessionID:        "randomSessionID",
+				UserID:           "randomUserID",
+				MachineID:        "randomMachineID",
+				Account:          "deploy",
+				Start:            1337,
+				End:              4337,
+				Duration:         3000,
+				ExitStatus:       &status,
+				BytesSent:        42,
+				BytesReceived:    4242,
+				DisconnectReason: "exit",
+			},
+			expectedInputs: `
+			{
+				"sessionEvent": {
+					"type": "ENDED",
+					"sessionId": "randomSessionID",
+					"userId": "randomUserID",
+					"machineId": "randomMachineID",
+					"account": "deploy",
+					"start": 1337,
+					"end": 4337,
+					"duration": 3000,
+					"exitStatus": 130,
+					"bytesSent": 42,
+					"bytesReceived": 4242,
+					"disconnectReason": "exit"
+				}
+			}
+			`,
+			resp: `
+			{
+				"data": {
+					"addSessionEvent": {
+						"success": false
+					}
+				}
+			}
+			`,
+			expectedResp: AddSessionEventResponse{},
+			err:          "",
+		},
+		{
+			name:  "invalid JSON response",
+			token: "token",
+			input: SessionEventInput{Type: SessionStarted},
+			expectedInputs: `
+			{
+				"sessionEvent": {
+					"type": "STARTED",
+					"sessionId": "",
+					"userId": "",
+					"machineId": "",
+					"account": "",
+					"start": 0
+				}
+			}
+			`,
+			resp: `
+			{
+				invalid json
+			}
+			`,
+			expectedResp: AddSessionEventResponse{},
+			err:          "addSessionEvent request failed: decoding response: invalid character 'i' looking for beginning of object key string",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Start a local HTTP server which mocks the corresponding GraphQL resolver beheviour.
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				// Check JWT in the header.
+				assert.Equal("JWT "+tc.token, req.Header.Get("Authorization"))
+
+				// Check GQL variables in the request.
+				assertGQLVarsEq(assert, tc.expectedInputs, req.Body)
+
+				rw.Write([]byte(tc.resp))
+			}))
+			defer server.Close()
+
+			client := NewClient(server.URL)
+			client.SetToken(tc.token)
+
+			resp, err := client.AddSessionEvent(context.Background(), tc.input)
+			if err != nil {
+				assert.Equalf(tc.err, err.Error(),
+					"expected error to be: %v, but actual is: %v", tc.err, err)
+			}
+
+			assert.Equalf(tc.expectedResp, resp,
+				"expected response to be: %+v, but actual is: %+v", tc.expectedResp, resp)
+		})
+	}
+}
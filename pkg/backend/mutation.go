@@ -18,3 +18,18 @@ func makeAddMachineLogRequest(token string, inputs []MachineLogInput) *gql.Reque
 	req.Var("machineLogs", inputs)
 	return req
 }
+
+const addSessionEventMutation = `
+	mutation addSessionEvent($sessionEvent: SessionEventInput!) {
+  	addSessionEvent(sessionEvent: $sessionEvent) {
+   	 success
+  	}
+	}
+`
+
+func makeAddSessionEventRequest(token string, input SessionEventInput) *gql.Request {
+	req := gql.NewRequest(addSessionEventMutation)
+	req.Header.Set("Authorization", token)
+	req.Var("sessionEvent", input)
+	return req
+}
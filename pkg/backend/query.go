@@ -28,6 +28,11 @@ const machinesQuery = `
 			name
 			ip
 			agentPort
+			sshPort
+			account
+			hostKeys
+			via
+			agentScheme
 		}
 	}
 `
@@ -46,6 +51,7 @@ const meQuery = `
 			firstName
 			lastName
 			job
+			role
 		}
 	}
 `
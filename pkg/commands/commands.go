@@ -2,10 +2,14 @@
 package commands
 
 import (
+	"context"
+	"os"
+	"os/signal"
 	"strings"
 
 	"github.com/gusmin/gate/pkg/core"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // SecureGateCommand is the Secure Gate command tree.
@@ -21,6 +25,14 @@ func NewSecureGateCommand(core *core.SecureGateCore) *SecureGateCommand {
 		newListCommand(core),
 		newMeCommand(core),
 		newConnectCommand(core),
+		newExecCommand(core),
+		newPexecCommand(core),
+		newPutCommand(core),
+		newGetCommand(core),
+		newForwardCommand(core),
+		newHostKeysCommand(core),
+		newKeysCommand(core),
+		newReplayCommand(core),
 		newLogoutCommand(core),
 		newExitCommand(core),
 	)
@@ -44,6 +56,44 @@ func (c *SecureGateCommand) Execute(cmd string) error {
 	}
 
 	c.root.SetArgs(args)
+	// The command tree is reused for every line so flags
+	// must not keep the values of the previous execution.
+	defer resetFlags(c.root)
 
 	return c.root.Execute()
 }
+
+// resetFlags sets back every flag of the command tree to its default value.
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if f.Changed {
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+
+	for _, c := range cmd.Commands() {
+		resetFlags(c)
+	}
+}
+
+// withInterrupt returns a copy of ctx which is canceled when the user hits
+// Ctrl-C or when the returned cancel function is called.
+func withInterrupt(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		defer signal.Stop(interrupt)
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
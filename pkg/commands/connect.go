@@ -1,16 +1,23 @@
 package commands
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net"
 	"os"
-	"path"
-	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gusmin/gate/pkg/backend"
 	"github.com/gusmin/gate/pkg/core"
+	"github.com/gusmin/gate/pkg/redact"
+	"github.com/olekukonko/tablewriter"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -26,41 +33,31 @@ func newConnectCommand(core *core.SecureGateCore) *cobra.Command {
 		SilenceUsage: true,
 		Args:         cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return connect(core.SSHUser, args[0], core.User(), core.Machines(), core.Logger)
+			return connect(core, args[0])
 		},
 	}
 }
 
-func connect(sshUser, machineName string, sgUser backend.User, machines []backend.Machine, logger *logrus.Logger) error {
-	// Check for existing node
-	var machine backend.Machine
-	for _, m := range machines {
-		if m.Name == machineName {
-			machine = m
-		}
-	}
-	if (backend.Machine{}) == machine {
-		return fmt.Errorf("%s is not part of accessible machines", machineName)
-	}
+func connect(core *core.SecureGateCore, machineName string) error {
+	sgUser := core.User()
+	logger := core.Logger
 
-	// Setup the config
-	signer, err := makePrivateKeySigner(path.Join(os.Getenv("HOME"), ".sgsh", sgUser.ID, "id_rsa"))
+	// Check for existing node
+	machine, err := findMachine(machineName, core.Machines(), core.Translator)
 	if err != nil {
-		return errors.Wrap(err, "could not make private key signer")
+		return err
 	}
-	config := &ssh.ClientConfig{
-		User:            sshUser,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	escapeChar, escapeEnabled, err := parseEscapeChar(core.Config.EscapeChar)
+	if err != nil {
+		return err
 	}
 
-	// Dial the server
-	// conn, err := ssh.Dial("tcp", machine.IP+":22", config)
-	conn, err := ssh.Dial("tcp", net.JoinHostPort(machine.IP, strconv.Itoa(machine.AgentPort)), config)
+	// Connect to the server, reusing the connection of a previous command
+	conn, err := core.Connect(context.Background(), machine)
 	if err != nil {
-		return errors.Wrapf(err, "failed to dial with %s", machineName)
+		return err
 	}
-	defer conn.Close()
+	defer conn.Release()
 
 	// Open a session
 	sess, err := conn.NewSession()
@@ -69,41 +66,135 @@ func connect(sshUser, machineName string, sgUser backend.User, machines []backen
 	}
 	defer sess.Close()
 
+	termFD := int(os.Stdin.Fd())
+	w, h, err := terminal.GetSize(termFD)
+	if err != nil {
+		return errors.Wrap(err, "could not get size of terminal")
+	}
+
 	// Loggers with session context
+	sessionID := newSessionID()
 	logFn := logger.WithFields(logrus.Fields{
 		"user":    sgUser.ID,
 		"machine": machine.ID,
+		"account": core.Account(machine),
+		"session": sessionID,
 	})
-	stdoutLogger := &sshTunnelLogger{log: logFn.Warnf}
-	stderrLogger := &sshTunnelLogger{log: logFn.Warnf}
+	outputLogFn := logFn.WithField("event", "output")
+	stdoutLogger := &sshTunnelLogger{log: outputLogFn.Warnf, redact: core.Redactor.Stream()}
+	stderrLogger := &sshTunnelLogger{log: outputLogFn.Warnf, redact: core.Redactor.Stream()}
+	// Command lines submitted by the user are audited on their own,
+	// except the ones typed while the remote is not echoing them
+	echo := &echoWatcher{}
+	inputLogger := &inputLogger{
+		log:    logFn.WithField("event", "input").Warnf,
+		redact: core.Redactor.Redact,
+		hidden: echo.off,
+	}
+
+	// Record the whole session for later audits, with its secrets masked
+	recorder, closeRecording, err := startRecording(core, machine, sessionID, w, h)
+	if err != nil {
+		return errors.Wrap(err, "could not start session recording")
+	}
+	defer closeRecording()
+	logFn.Infof(core.Translator.Translate("SessionRecorded"), sessionID)
+	// Both outputs share the terminal, so they share the redaction too
+	// to be recorded in the order they are displayed.
+	outputRecorder := newRedactWriter(recorder, core.Redactor.Stream())
+
+	// Put the terminal in raw mode and save the old state
+	termState, err := terminal.MakeRaw(termFD)
+	if err != nil {
+		return errors.Wrap(err, "could not put the terminal in raw mode")
+	}
+	// Restore terminal state
+	defer terminal.Restore(termFD, termState)
+
+	// The session is closed when the machine stops answering keepalives,
+	// the user stays idle for too long or disconnects with an escape sequence,
+	// with the reason kept to be reported.
+	disconnected := make(chan disconnection, 1)
+	disconnect := func(d disconnection) {
+		select {
+		case disconnected <- d:
+			logFn.Warnf("disconnected: %s\n", d.reason)
+			sess.Close()
+		default:
+		}
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	if interval := core.Config.KeepaliveInterval; interval > 0 {
+		maxMissed := core.Config.KeepaliveMaxMissed
+		go func() {
+			if !keepAlive(conn, interval, maxMissed, stop) {
+				disconnect(disconnection{
+					reason: "keepalive timeout",
+					err:    fmt.Errorf(core.Translator.Translate("KeepaliveTimeout"), machine.Name),
+				})
+				// The connection is dead and must not be reused
+				conn.Close()
+			}
+		}()
+	}
 
 	stdinPipe, err := sess.StdinPipe()
 	if err != nil {
 		return errors.Wrap(err, "could not pipe stdin")
 	}
-	go io.Copy(stdinPipe, os.Stdin)
+	start := time.Now()
+	input := newActivityReader(os.Stdin)
+	var stdin io.Reader = input
+	if escapeEnabled {
+		stdin = newEscapeReader(
+			input,
+			escapeChar,
+			os.Stdout,
+			fmt.Sprintf(core.Translator.Translate("EscapeHelp"), escapeChar),
+			func() string {
+				return connectionDetails(core, conn.Client, machine, sessionID, time.Since(start))
+			},
+			func() {
+				disconnect(disconnection{reason: "escape sequence"})
+			},
+		)
+	}
+	// Count the bytes exchanged for the session events
+	var sent, received byteCounter
+	go io.Copy(stdinPipe, io.TeeReader(stdin, io.MultiWriter(inputLogger, &sent)))
+
+	if timeout := core.Config.IdleTimeout; timeout > 0 {
+		go func() {
+			if waitIdle(input, timeout, stop) {
+				disconnect(disconnection{
+					reason: "idle timeout",
+					err:    fmt.Errorf(core.Translator.Translate("IdleTimeout"), machine.Name, timeout),
+				})
+			}
+		}()
+	}
 
 	// Pipe stdout and sterr with logs
+	var output sync.WaitGroup
 	stdoutPipe, err := sess.StdoutPipe()
 	if err != nil {
 		return errors.Wrap(err, "could not pipe stdout")
 	}
-	go io.Copy(io.MultiWriter(os.Stdout, stdoutLogger), stdoutPipe)
-
 	stderrPipe, err := sess.StderrPipe()
 	if err != nil {
 		return errors.Wrap(err, "could not pipe stderr")
 	}
-	go io.Copy(io.MultiWriter(os.Stderr, stderrLogger), stderrPipe)
-
-	// Put the terminal in raw mode and save the old state
-	termFD := int(os.Stdin.Fd())
-	termState, err := terminal.MakeRaw(termFD)
-	if err != nil {
-		return errors.Wrap(err, "could not put the terminal in raw mode")
-	}
-	// Restore terminal state
-	defer terminal.Restore(termFD, termState)
+	output.Add(2)
+	go func() {
+		defer output.Done()
+		io.Copy(io.MultiWriter(os.Stdout, stdoutLogger, outputRecorder, echo, &received), stdoutPipe)
+	}()
+	go func() {
+		defer output.Done()
+		io.Copy(io.MultiWriter(os.Stderr, stderrLogger, outputRecorder, echo, &received), stderrPipe)
+	}()
 
 	// Terminal attributes and size for pty
 	modes := ssh.TerminalModes{
@@ -112,10 +203,6 @@ func connect(sshUser, machineName string, sgUser backend.User, machines []backen
 		ssh.TTY_OP_ISPEED: 115200, // baud in
 		ssh.TTY_OP_OSPEED: 115200, // baud out
 	}
-	w, h, err := terminal.GetSize(termFD)
-	if err != nil {
-		return errors.Wrap(err, "could not get size of terminal")
-	}
 
 	// Request pty for the session
 	err = sess.RequestPty("xterm-256color", h, w, modes)
@@ -123,28 +210,166 @@ func connect(sshUser, machineName string, sgUser backend.User, machines []backen
 		return errors.Wrap(err, "failed to request pty")
 	}
 
+	logFn.Warnf("window size %dx%d\n", w, h)
+
+	// Forward terminal resizes so full-screen programs keep a correct layout
+	stopWatching := watchWindowSize(termFD, func(width, height int) {
+		err := sess.WindowChange(height, width)
+		if err != nil {
+			return
+		}
+		recorder.Resize(width, height)
+		logFn.Warnf("window resized to %dx%d\n", width, height)
+	})
+	defer stopWatching()
+
 	// Start a shell on the remote host
 	err = sess.Shell()
 	if err != nil {
 		return errors.Wrap(err, "could not start shell on the remote host")
 	}
+	event := backend.SessionEventInput{
+		Type:      backend.SessionStarted,
+		SessionID: sessionID,
+		UserID:    sgUser.ID,
+		MachineID: machine.ID,
+		Account:   core.Account(machine),
+		Start:     backend.Timestamp(start),
+	}
+	core.ReportSessionEvent(event)
 
 	// Wait for the shell to exit
-	return sess.Wait()
+	err = sess.Wait()
+
+	// Log what remains of the output once it is fully copied
+	output.Wait()
+	stdoutLogger.Flush()
+	stderrLogger.Flush()
+	outputRecorder.Flush()
+
+	var d *disconnection
+	select {
+	case reason := <-disconnected:
+		d = &reason
+	default:
+	}
+	event = sessionEnded(event, time.Now(), err, d)
+	event.BytesSent = sent.Count()
+	event.BytesReceived = received.Count()
+	core.ReportSessionEvent(event)
+
+	if d != nil {
+		return d.err
+	}
+	return err
 }
 
-// makePrivateKeySigner creates a signer from a private SSH key.
-func makePrivateKeySigner(file string) (ssh.Signer, error) {
-	buffer, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read SSH key from %s", file)
+// disconnection is the reason why the gate closed a connection.
+type disconnection struct {
+	reason string // reported in the session events
+	err    error  // returned to the user if not nil
+}
+
+// sessionEnded completes the event of a started session with its end, the
+// error returned by the session and the disconnection by the gate if any.
+func sessionEnded(event backend.SessionEventInput, end time.Time, err error, d *disconnection) backend.SessionEventInput {
+	event.Type = backend.SessionEnded
+	event.End = backend.Timestamp(end)
+	event.Duration = event.End - event.Start
+
+	switch e := err.(type) {
+	case nil:
+		status := 0
+		event.ExitStatus = &status
+		event.DisconnectReason = "exit"
+	case *ssh.ExitError:
+		if e.Signal() != "" {
+			event.ExitSignal = e.Signal()
+		} else {
+			status := e.ExitStatus()
+			event.ExitStatus = &status
+		}
+		event.DisconnectReason = "exit"
+	case *ssh.ExitMissingError:
+		event.DisconnectReason = "closed by the remote"
+	default:
+		event.DisconnectReason = "connection lost: " + err.Error()
 	}
 
-	key, err := ssh.ParsePrivateKey(buffer)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse private SSH key")
+	// The gate closing the connection takes precedence
+	// over what the remote reported.
+	if d != nil {
+		event.DisconnectReason = d.reason
 	}
-	return key, nil
+	return event
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter struct {
+	n int64 // accessed atomically
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.n, int64(len(p)))
+	return len(p), nil
+}
+
+// Count returns the number of bytes written so far.
+func (c *byteCounter) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// connectionDetails describes the connection with the machine.
+func connectionDetails(core *core.SecureGateCore, conn *ssh.Client, machine backend.Machine, sessionID string, duration time.Duration) string {
+	var route []string
+	chain, _ := core.JumpChain(machine)
+	for _, m := range chain {
+		route = append(route, m.Name)
+	}
+
+	return fmt.Sprintf(
+		core.Translator.Translate("ConnectionDetails"),
+		machine.Name,
+		machine.ID,
+		strings.Join(route, " -> "),
+		conn.RemoteAddr(),
+		conn.User(),
+		conn.ServerVersion(),
+		sessionID,
+		duration.Round(time.Second),
+	)
+}
+
+// newSessionID generates a random identifier for a connection.
+func newSessionID() string {
+	b := make([]byte, 16)
+	// crypto/rand reader only fails when the system is broken
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// findMachine resolves the reference to one of the accessible machines.
+// The candidates of an ambiguous reference are listed in a table.
+func findMachine(ref string, machines []backend.Machine, translator core.Translator) (backend.Machine, error) {
+	machine, err := core.ResolveMachine(ref, machines)
+	if err, ok := err.(*core.AmbiguousMachineError); ok {
+		var sb strings.Builder
+
+		// Write table into the string.Builder.
+		table := tablewriter.NewWriter(&sb)
+		table.SetHeader([]string{
+			translator.Translate("ID"),
+			translator.Translate("Name"),
+			translator.Translate("IP"),
+		})
+		for _, m := range err.Candidates {
+			table.Append([]string{m.ID, m.Name, m.IP})
+		}
+		table.Render()
+
+		return backend.Machine{}, errors.Errorf("%v:\n%s", err, sb.String())
+	}
+	return machine, err
 }
 
 // logFunc logs the format with the given args.
@@ -152,9 +377,11 @@ type logFunc func(format string, args ...interface{})
 
 // sshTunnelLogger bufferize written bytes until
 // a CRLF, then flush the buffer with the logFunc.
+// Secrets are masked by the redaction stream if any.
 type sshTunnelLogger struct {
 	buffer []byte
 	log    logFunc
+	redact *redact.Stream
 }
 
 func (w *sshTunnelLogger) Write(p []byte) (n int, err error) {
@@ -164,10 +391,151 @@ func (w *sshTunnelLogger) Write(p []byte) (n int, err error) {
 	// check for new lines
 	for i := 0; i < len(w.buffer); i++ {
 		if w.buffer[i] == '\n' {
-			w.log("%s\n", string(w.buffer[:i])) // flush the buffer until i without the new line
+			w.log("%s\n", w.line(w.buffer[:i])) // flush the buffer until i without the new line
 			w.buffer = w.buffer[i+1:]           // trim the buffer without the new line at position
+			i = -1                              // look for the next new line from the start of the buffer
 		}
 	}
 
 	return len(p), nil
 }
+
+// Flush logs the buffered bytes not terminated by a new line.
+func (w *sshTunnelLogger) Flush() {
+	if len(w.buffer) == 0 {
+		return
+	}
+	w.log("%s\n", w.line(w.buffer))
+	w.buffer = nil
+}
+
+// line returns the line to log with its secrets masked.
+func (w *sshTunnelLogger) line(b []byte) string {
+	if w.redact == nil {
+		return string(b)
+	}
+	return w.redact.Line(string(b))
+}
+
+// Output not ending a line is held back for at most recordingHoldBack or
+// recordingMaxHoldBack bytes, to be redacted along with the rest of its line
+// without delaying prompts and full-screen programs in the recording.
+const (
+	recordingHoldBack    = 100 * time.Millisecond
+	recordingMaxHoldBack = 4096
+)
+
+// redactWriter writes the lines written to it to w once their secrets are
+// masked by the redaction stream. The bytes of a line are held back until
+// its new line, for a bounded time or size, so that a secret split between
+// writes is masked as a whole.
+type redactWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	redact *redact.Stream
+	buffer []byte
+	hold   time.Duration // how long bytes are held back at most
+	timer  *time.Timer   // writes the held back bytes once expired
+	err    error         // of the last write by the timer
+}
+
+func newRedactWriter(w io.Writer, stream *redact.Stream) *redactWriter {
+	return &redactWriter{w: w, redact: stream, hold: recordingHoldBack}
+}
+
+// Write always consumes p, the error being the one of writing to w.
+func (w *redactWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buffer = append(w.buffer, p...)
+	err := w.writeLines()
+	if err == nil && len(w.buffer) >= recordingMaxHoldBack {
+		err = w.writeHeld(false)
+	}
+	if err == nil && len(w.buffer) > 0 && w.timer == nil {
+		w.timer = time.AfterFunc(w.hold, w.expire)
+	}
+	if err == nil {
+		err, w.err = w.err, nil
+	}
+	return len(p), err
+}
+
+// Flush writes the held back bytes.
+func (w *redactWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	err := w.writeHeld(true)
+	if err == nil {
+		err, w.err = w.err, nil
+	}
+	return err
+}
+
+// expire writes the bytes held back for too long.
+func (w *redactWriter) expire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.timer = nil
+	if err := w.writeHeld(false); err != nil {
+		w.err = err
+	}
+}
+
+// writeLines writes the complete lines of the buffer.
+func (w *redactWriter) writeLines() error {
+	for {
+		i := bytes.IndexByte(w.buffer, '\n')
+		if i < 0 {
+			return nil
+		}
+		// Terminals end their lines with CRLF
+		line, eol := w.buffer[:i], "\n"
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line, eol = line[:len(line)-1], "\r\n"
+		}
+		masked := w.redact.Line(string(line))
+		w.buffer = w.buffer[i+1:]
+		if _, err := io.WriteString(w.w, masked+eol); err != nil {
+			return err
+		}
+	}
+}
+
+// writeHeld writes the bytes of the buffer not terminated by a new line,
+// but a trailing incomplete UTF-8 character unless all is written.
+func (w *redactWriter) writeHeld(all bool) error {
+	n := len(w.buffer)
+	if !all {
+		n = completeRunes(w.buffer)
+	}
+	if n == 0 {
+		return nil
+	}
+	line := w.redact.Line(string(w.buffer[:n]))
+	w.buffer = append(w.buffer[:0], w.buffer[n:]...)
+	_, err := io.WriteString(w.w, line)
+	return err
+}
+
+// completeRunes returns the length of b without its trailing
+// incomplete UTF-8 character if any.
+func completeRunes(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+		if !utf8.FullRune(b[i:]) {
+			return i
+		}
+		break
+	}
+	return len(b)
+}
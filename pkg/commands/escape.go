@@ -0,0 +1,110 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// parseEscapeChar parses the configured escape character, either a single
+// character or a control character in caret notation like "^]".
+// The escape character is disabled with "none" or an empty string.
+func parseEscapeChar(s string) (c byte, enabled bool, err error) {
+	switch {
+	case s == "" || s == "none":
+		return 0, false, nil
+	case len(s) == 1 && s[0] < 0x80:
+		return s[0], true, nil
+	case len(s) == 2 && s[0] == '^' && s[1] >= '@' && s[1] <= '_':
+		return s[1] & 0x1f, true, nil
+	default:
+		return 0, false, fmt.Errorf("invalid escape character %q", s)
+	}
+}
+
+// escapeReader interprets the escape sequences typed by the user at the
+// beginning of a line, like OpenSSH does, and passes the rest of the input
+// through. The escape character followed by "." disconnects, by "?" displays
+// the help, by "C" or "#" displays the connection details and by itself
+// sends the escape character once.
+type escapeReader struct {
+	r          io.Reader
+	char       byte      // escape character
+	term       io.Writer // where the help and details are displayed
+	help       string    // help of the escape sequences
+	details    func() string
+	disconnect func()
+
+	newLine bool   // at the beginning of a line
+	escaped bool   // escape character typed at the beginning of a line
+	buffer  []byte // input read but not returned yet
+	err     error  // error of the underlying reader once the buffer is empty
+}
+
+func newEscapeReader(r io.Reader, char byte, term io.Writer, help string, details func() string, disconnect func()) *escapeReader {
+	return &escapeReader{
+		r:          r,
+		char:       char,
+		term:       term,
+		help:       help,
+		details:    details,
+		disconnect: disconnect,
+		newLine:    true,
+	}
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	in := make([]byte, len(p))
+	for len(e.buffer) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		n, err := e.r.Read(in)
+		for _, c := range in[:n] {
+			e.filter(c)
+		}
+		e.err = err
+	}
+
+	n := copy(p, e.buffer)
+	e.buffer = e.buffer[n:]
+	return n, nil
+}
+
+// filter handles a byte of input.
+func (e *escapeReader) filter(c byte) {
+	if e.escaped {
+		e.escaped = false
+		switch c {
+		case '.':
+			e.print(string(e.char) + ".\n")
+			e.disconnect()
+			return
+		case '?':
+			e.print(string(e.char) + "?\n" + e.help)
+			e.newLine = true
+			return
+		case 'C', '#':
+			e.print(string(e.char) + string(c) + "\n" + e.details())
+			e.newLine = true
+			return
+		case e.char:
+			e.buffer = append(e.buffer, c)
+			e.newLine = false
+			return
+		}
+		// Not an escape sequence after all.
+		e.buffer = append(e.buffer, e.char)
+	} else if e.newLine && c == e.char {
+		e.escaped = true
+		return
+	}
+
+	e.buffer = append(e.buffer, c)
+	e.newLine = c == '\r' || c == '\n'
+}
+
+// print displays the text on the terminal which is in raw mode.
+func (e *escapeReader) print(text string) {
+	fmt.Fprint(e.term, strings.Replace(text, "\n", "\r\n", -1))
+}
@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/core"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// ExitStatusError is returned when a remote command exits with a non-zero status.
+type ExitStatusError struct {
+	Machine string // name of the machine
+	Status  int    // exit status of the remote command
+}
+
+func (e *ExitStatusError) Error() string {
+	return fmt.Sprintf("command exited with status %d on %s", e.Status, e.Machine)
+}
+
+// newExecCommand creates a new "exec" command tied to the given core.
+func newExecCommand(core *core.SecureGateCore) *cobra.Command {
+	return &cobra.Command{
+		Use:          "exec [machine] -- [command]",
+		Short:        core.Translator.Translate("ExecShortDesc"),
+		Long:         core.Translator.Translate("ExecShortDesc"),
+		SilenceUsage: true,
+		Args:         cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Everything after the machine is the remote command,
+			// "--" is only needed when it contains flags.
+			if dash := cmd.ArgsLenAtDash(); dash > 1 {
+				return fmt.Errorf("expected a single machine before --, got %d arguments", dash)
+			}
+
+			machine, err := findMachine(args[0], core.Machines(), core.Translator)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := withInterrupt(context.Background())
+			defer cancel()
+
+			return execute(ctx, core, machine, strings.Join(args[1:], " "), os.Stdout, os.Stderr)
+		},
+	}
+}
+
+// execute runs the command on the machine, streams its output to stdout and
+// stderr and audits both the command line and its output.
+// The command is aborted when the context is done.
+func execute(ctx context.Context, core *core.SecureGateCore, machine backend.Machine, command string, stdout, stderr io.Writer) error {
+	// Connect to the server, reusing the connection of a previous command
+	conn, err := core.Connect(ctx, machine)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// Open a session
+	sess, err := conn.NewSession()
+	if err != nil {
+		return errors.Wrap(err, "failed to create new SSH session")
+	}
+	defer sess.Close()
+
+	// Abort the command by closing the session when the context is done
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.Close()
+		case <-finished:
+		}
+	}()
+
+	// Loggers with session context
+	logFn := core.Logger.WithFields(logrus.Fields{
+		"user":    core.User().ID,
+		"machine": machine.ID,
+		"account": core.Account(machine),
+		"session": newSessionID(),
+	})
+	stdoutLogger := &sshTunnelLogger{log: logFn.Warnf, redact: core.Redactor.Stream()}
+	stderrLogger := &sshTunnelLogger{log: logFn.Warnf, redact: core.Redactor.Stream()}
+	sess.Stdout = io.MultiWriter(stdout, stdoutLogger)
+	sess.Stderr = io.MultiWriter(stderr, stderrLogger)
+
+	logFn.Warnf("exec %s\n", core.Redactor.Redact(command))
+	err = sess.Run(command)
+
+	// Log what remains of the output once the command is over
+	stdoutLogger.Flush()
+	stderrLogger.Flush()
+
+	if ctx.Err() != nil {
+		logFn.Warnf("aborted: %v\n", ctx.Err())
+		return errors.Wrapf(ctx.Err(), "command aborted on %s", machine.Name)
+	}
+
+	switch err := err.(type) {
+	case nil:
+		logFn.Warnf("exit status 0\n")
+		return nil
+	case *ssh.ExitError:
+		logFn.Warnf("exit status %d\n", err.ExitStatus())
+		return &ExitStatusError{Machine: machine.Name, Status: err.ExitStatus()}
+	default:
+		return errors.Wrapf(err, "failed to run command on %s", machine.Name)
+	}
+}
@@ -0,0 +1,206 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gusmin/gate/pkg/core"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// newForwardCommand creates a new "forward" command tied to the given core.
+func newForwardCommand(core *core.SecureGateCore) *cobra.Command {
+	return &cobra.Command{
+		Use:          "forward [machine] [localport]:[remotehost]:[remoteport]",
+		Short:        core.Translator.Translate("ForwardShortDesc"),
+		Long:         core.Translator.Translate("ForwardShortDesc"),
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			spec, err := parseForwardSpec(args[1])
+			if err != nil {
+				return err
+			}
+			machine, err := findMachine(args[0], core.Machines(), core.Translator)
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := withInterrupt(context.Background())
+			defer cancel()
+
+			// Connect to the server, reusing the connection of a previous command
+			conn, err := core.Connect(ctx, machine)
+			if err != nil {
+				return err
+			}
+			defer conn.Release()
+
+			listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(spec.localPort)))
+			if err != nil {
+				return errors.Wrapf(err, "could not listen on local port %d", spec.localPort)
+			}
+
+			core.Logger.Infof(core.Translator.Translate("ForwardStarted"), listener.Addr().String(), spec.remote())
+
+			logFn := core.Logger.WithFields(logrus.Fields{
+				"user":    core.User().ID,
+				"machine": machine.ID,
+				"account": core.Account(machine),
+				"session": newSessionID(),
+			})
+			return forward(ctx, listener, conn.Client, spec.remote(), logFn)
+		},
+	}
+}
+
+// forwardSpec describes a local port forwarding.
+type forwardSpec struct {
+	localPort  int
+	remoteHost string
+	remotePort int
+}
+
+// remote returns the address the forwarded connections are opened to.
+func (s forwardSpec) remote() string {
+	return net.JoinHostPort(s.remoteHost, strconv.Itoa(s.remotePort))
+}
+
+// parseForwardSpec parses a forwarding formatted as localport:remotehost:remoteport.
+// IPv6 remote hosts must be enclosed in square brackets.
+func parseForwardSpec(s string) (forwardSpec, error) {
+	invalid := fmt.Errorf("invalid forwarding %s, expected localport:remotehost:remoteport", s)
+
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return forwardSpec{}, invalid
+	}
+	host, port, err := net.SplitHostPort(s[i+1:])
+	if err != nil || host == "" {
+		return forwardSpec{}, invalid
+	}
+
+	var spec forwardSpec
+	spec.remoteHost = host
+	if spec.localPort, err = parsePort(s[:i]); err != nil {
+		return forwardSpec{}, invalid
+	}
+	if spec.remotePort, err = parsePort(port); err != nil {
+		return forwardSpec{}, invalid
+	}
+	return spec, nil
+}
+
+// parsePort parses a TCP port number.
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+	return port, nil
+}
+
+// forward accepts connections on the listener and forwards each of them
+// to the remote address through a direct-tcpip channel of the SSH client
+// until the context is done or the SSH connection is lost. Every forwarded
+// connection is audited when it is opened and closed, with the number of
+// bytes sent each way.
+func forward(ctx context.Context, listener net.Listener, client *ssh.Client, remote string, logFn *logrus.Entry) error {
+	// Stop accepting connections when the context is done
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	// or when they could not be forwarded anymore
+	lost := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(lost)
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			select {
+			case <-lost:
+				return errors.New("connection to the machine lost")
+			default:
+			}
+			return errors.Wrap(err, "could not accept connection")
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer local.Close()
+
+			from := local.RemoteAddr().String()
+			channel, err := client.Dial("tcp", remote)
+			if err != nil {
+				logFn.Warnf("forward %s -> %s refused: %v\n", from, remote, err)
+				return
+			}
+			defer channel.Close()
+			logFn.Warnf("forward %s -> %s opened\n", from, remote)
+
+			// Close both ends when the context is done
+			finished := make(chan struct{})
+			defer close(finished)
+			go func() {
+				select {
+				case <-ctx.Done():
+					local.Close()
+					channel.Close()
+				case <-finished:
+				}
+			}()
+
+			sent, received := pipe(local, channel)
+			logFn.Warnf("forward %s -> %s closed (%d bytes sent, %d bytes received)\n", from, remote, sent, received)
+		}()
+	}
+}
+
+// pipe copies data both ways between the local connection and the remote
+// channel until both directions are over, and returns the number of bytes
+// sent to the remote and received from it.
+func pipe(local, remote net.Conn) (sent, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(local, remote)
+		// The remote is done sending, so is the local connection.
+		local.Close()
+	}()
+
+	sent, _ = io.Copy(remote, local)
+	// Signal the end of the stream to the remote without dropping
+	// what it still has to send back.
+	if cw, ok := remote.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		remote.Close()
+	}
+	wg.Wait()
+
+	return sent, received
+}
@@ -0,0 +1,129 @@
+package commands
+
+import (
+	"strings"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/core"
+	"github.com/gusmin/gate/pkg/database"
+	"github.com/olekukonko/tablewriter"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// newHostKeysCommand creates a new "hostkeys" command tied to the given core.
+func newHostKeysCommand(core *core.SecureGateCore) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "hostkeys",
+		Short: core.Translator.Translate("HostKeysShortDesc"),
+		Long:  core.Translator.Translate("HostKeysShortDesc"),
+	}
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:          "list",
+			Short:        core.Translator.Translate("HostKeysListShortDesc"),
+			Long:         core.Translator.Translate("HostKeysListShortDesc"),
+			SilenceUsage: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				hostKeys, err := core.HostKeys()
+				if err != nil {
+					return err
+				}
+				listHostKeys(core.User(), core.Machines(), hostKeys, core.Logger, core.Translator)
+				return nil
+			},
+		},
+		&cobra.Command{
+			Use:          "approve [machine]",
+			Short:        core.Translator.Translate("HostKeysApproveShortDesc"),
+			Long:         core.Translator.Translate("HostKeysApproveShortDesc"),
+			SilenceUsage: true,
+			Args:         cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				machine, err := findMachine(args[0], core.Machines(), core.Translator)
+				if err != nil {
+					return err
+				}
+				err = core.ApproveHostKey(machine.ID)
+				if err != nil {
+					return err
+				}
+				core.Logger.WithFields(logrus.Fields{
+					"user":    core.User().ID,
+					"machine": machine.ID,
+					"account": core.Account(machine),
+				}).Warnf(core.Translator.Translate("HostKeyApproved"), machine.Name)
+				return nil
+			},
+		},
+		&cobra.Command{
+			Use:          "forget [machine]",
+			Short:        core.Translator.Translate("HostKeysForgetShortDesc"),
+			Long:         core.Translator.Translate("HostKeysForgetShortDesc"),
+			SilenceUsage: true,
+			Args:         cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				machine, err := findMachine(args[0], core.Machines(), core.Translator)
+				if err != nil {
+					return err
+				}
+				err = core.ForgetHostKey(machine.ID)
+				if err != nil {
+					return err
+				}
+				core.Logger.WithFields(logrus.Fields{
+					"user":    core.User().ID,
+					"machine": machine.ID,
+					"account": core.Account(machine),
+				}).Warnf(core.Translator.Translate("HostKeyForgotten"), machine.Name)
+				return nil
+			},
+		},
+	)
+
+	return cmd
+}
+
+// listHostKeys lists pinned host keys with the logger in a table.
+func listHostKeys(
+	user backend.User,
+	machines []backend.Machine,
+	hostKeys []database.HostKey,
+	logger *logrus.Logger, translator core.Translator) {
+
+	names := make(map[string]string)
+	for _, m := range machines {
+		names[m.ID] = m.Name
+	}
+
+	var sb strings.Builder
+
+	// Write table into the string.Builder.
+	table := tablewriter.NewWriter(&sb)
+	table.SetHeader([]string{
+		translator.Translate("ID"),
+		translator.Translate("Name"),
+		translator.Translate("Fingerprint"),
+		translator.Translate("Source"),
+		translator.Translate("PendingFingerprint"),
+	})
+	table.SetCaption(true, translator.Translate("HostKeysCaption"))
+
+	// Fill the table.
+	for _, hostKey := range hostKeys {
+		table.Append([]string{
+			hostKey.MachineID,
+			names[hostKey.MachineID],
+			core.HostKeyFingerprint(hostKey.Key),
+			hostKey.Source,
+			core.HostKeyFingerprint(hostKey.Pending),
+		})
+	}
+
+	// Render the table into the string.Builder.
+	table.Render()
+
+	logger.WithFields(logrus.Fields{
+		"user": user.ID,
+	}).Infof(sb.String())
+}
@@ -0,0 +1,270 @@
+package commands
+
+import (
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Control characters handled by the input logger.
+const (
+	keyCtrlA     = 0x01
+	keyCtrlC     = 0x03
+	keyCtrlE     = 0x05
+	keyBackspace = 0x08
+	keyTab       = 0x09
+	keyLF        = 0x0a
+	keyCtrlK     = 0x0b
+	keyCR        = 0x0d
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// inputLogger rebuilds the command lines typed by the user from the raw
+// terminal input and logs each of them with the logFunc once submitted.
+// It understands line edition (backspace, cursor moves, line killing) and
+// the arrow keys history of a shell, but can not know about what the remote
+// program does with the input, like completions, which are kept as tabs.
+// Lines typed while hidden reports true are not logged and the others are
+// logged once redacted.
+type inputLogger struct {
+	log    logFunc
+	redact func(string) string // masks the secrets of a line if not nil
+	hidden func() bool         // reports whether the input is hidden if not nil
+
+	line    []rune   // line being edited
+	cursor  int      // position of the cursor in the line
+	history []string // submitted lines
+	recall  int      // position in the history when browsing it
+
+	pending   []byte    // incomplete escape sequence or UTF-8 character
+	pendingAt time.Time // when the pending bytes were written
+	secret    bool      // part of the line was typed while hidden
+}
+
+// escapeTimeout is the delay after which an escape is considered to be
+// a lone escape key, the bytes of escape sequences being sent at once.
+const escapeTimeout = 100 * time.Millisecond
+
+func (w *inputLogger) Write(p []byte) (int, error) {
+	if len(w.pending) > 0 && w.pending[0] == keyEscape && time.Since(w.pendingAt) > escapeTimeout {
+		w.pending = w.pending[1:]
+	}
+	b := append(w.pending, p...)
+	w.pending = nil
+
+	if w.hidden != nil && w.hidden() {
+		w.secret = true
+	}
+
+	for len(b) > 0 {
+		n := w.consume(b)
+		if n == 0 {
+			// Wait for the rest of the sequence.
+			w.pending = append([]byte(nil), b...)
+			w.pendingAt = time.Now()
+			break
+		}
+		b = b[n:]
+	}
+	return len(p), nil
+}
+
+// consume handles the key at the beginning of b and returns its length,
+// or 0 if b does not hold a complete key yet.
+func (w *inputLogger) consume(b []byte) int {
+	switch c := b[0]; c {
+	case keyCR, keyLF:
+		w.submit()
+		// Terminals send CRLF on some systems.
+		if c == keyCR && len(b) > 1 && b[1] == keyLF {
+			return 2
+		}
+		return 1
+	case keyBackspace, keyDelete:
+		if w.cursor > 0 {
+			w.line = append(w.line[:w.cursor-1], w.line[w.cursor:]...)
+			w.cursor--
+		}
+		return 1
+	case keyCtrlA:
+		w.cursor = 0
+		return 1
+	case keyCtrlE:
+		w.cursor = len(w.line)
+		return 1
+	case keyCtrlK:
+		w.line = w.line[:w.cursor]
+		return 1
+	case keyCtrlU:
+		w.line = append([]rune(nil), w.line[w.cursor:]...)
+		w.cursor = 0
+		return 1
+	case keyCtrlW:
+		start := w.cursor
+		for start > 0 && w.line[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && w.line[start-1] != ' ' {
+			start--
+		}
+		w.line = append(w.line[:start], w.line[w.cursor:]...)
+		w.cursor = start
+		return 1
+	case keyCtrlC:
+		w.reset()
+		return 1
+	case keyTab:
+		w.insert('\t')
+		return 1
+	case keyEscape:
+		return w.escape(b)
+	}
+
+	if b[0] < 0x20 {
+		// Other control characters do not edit the line.
+		return 1
+	}
+
+	if !utf8.FullRune(b) {
+		return 0
+	}
+	r, size := utf8.DecodeRune(b)
+	w.insert(r)
+	return size
+}
+
+// escape handles the escape sequence at the beginning of b
+// and returns its length, or 0 if it is not complete yet.
+func (w *inputLogger) escape(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	if b[1] != '[' && b[1] != 'O' {
+		// Lone escape key, the next byte is another key.
+		return 1
+	}
+
+	// CSI and SS3 sequences end with a byte in the range @ to ~.
+	end := 2
+	for end < len(b) && (b[end] < 0x40 || b[end] > 0x7e) {
+		end++
+	}
+	if end == len(b) {
+		return 0
+	}
+
+	switch seq := string(b[2 : end+1]); seq {
+	case "A":
+		w.browse(-1)
+	case "B":
+		w.browse(1)
+	case "C":
+		if w.cursor < len(w.line) {
+			w.cursor++
+		}
+	case "D":
+		if w.cursor > 0 {
+			w.cursor--
+		}
+	case "H", "1~", "7~":
+		w.cursor = 0
+	case "F", "4~", "8~":
+		w.cursor = len(w.line)
+	case "3~":
+		if w.cursor < len(w.line) {
+			w.line = append(w.line[:w.cursor], w.line[w.cursor+1:]...)
+		}
+	}
+	return end + 1
+}
+
+// insert inserts the rune at the cursor.
+func (w *inputLogger) insert(r rune) {
+	w.line = append(w.line, 0)
+	copy(w.line[w.cursor+1:], w.line[w.cursor:])
+	w.line[w.cursor] = r
+	w.cursor++
+}
+
+// browse replaces the line with an entry of the history,
+// offset from the current one, like arrow keys do.
+func (w *inputLogger) browse(offset int) {
+	recall := w.recall + offset
+	if recall < 0 || recall > len(w.history) {
+		return
+	}
+	w.recall = recall
+	if recall == len(w.history) {
+		w.line, w.cursor = nil, 0
+		return
+	}
+	w.line = []rune(w.history[recall])
+	w.cursor = len(w.line)
+}
+
+// submit logs the line and adds it to the history.
+// Empty and secret lines are not logged.
+func (w *inputLogger) submit() {
+	if line := string(w.line); line != "" && !w.secret {
+		if w.redact != nil {
+			w.log("%s\n", w.redact(line))
+		} else {
+			w.log("%s\n", line)
+		}
+		w.history = append(w.history, line)
+	}
+	w.reset()
+}
+
+// reset discards the line being edited.
+func (w *inputLogger) reset() {
+	w.line = nil
+	w.cursor = 0
+	w.recall = len(w.history)
+	w.secret = false
+}
+
+// passwordPrompt matches the prompts after which the remote
+// turns its echo off to read a secret.
+var passwordPrompt = regexp.MustCompile(`(?i)\b(password|passphrase|passcode|pin|secret)\b[^:\n]*:\s*$`)
+
+// echoWatcher watches the remote output to guess whether the remote echo is
+// off. The echo of a pseudo terminal is not visible from the client side,
+// so it is considered off while the output ends with a password prompt.
+type echoWatcher struct {
+	mu   sync.Mutex
+	tail []byte // output since the last new line
+}
+
+// maxPromptLen bounds the output kept to recognize a prompt.
+const maxPromptLen = 256
+
+func (e *echoWatcher) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := len(p)
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i] == '\n' {
+			e.tail = e.tail[:0]
+			p = p[i+1:]
+			break
+		}
+	}
+	e.tail = append(e.tail, p...)
+	if len(e.tail) > maxPromptLen {
+		e.tail = append(e.tail[:0], e.tail[len(e.tail)-maxPromptLen:]...)
+	}
+	return n, nil
+}
+
+// off reports whether the remote echo is guessed off.
+func (e *echoWatcher) off() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return passwordPrompt.Match(e.tail)
+}
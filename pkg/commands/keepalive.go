@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// requestSender sends global requests over an SSH connection.
+type requestSender interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
+}
+
+// defaultKeepaliveMaxMissed is the number of unanswered keepalives in a row
+// before disconnecting when none is configured.
+const defaultKeepaliveMaxMissed = 3
+
+// keepAlive sends a keepalive@openssh.com request over the connection every
+// interval until stop is closed. It returns false as soon as maxMissed
+// requests in a row went unanswered or the connection is broken.
+func keepAlive(conn requestSender, interval time.Duration, maxMissed int, stop <-chan struct{}) bool {
+	if maxMissed <= 0 {
+		maxMissed = defaultKeepaliveMaxMissed
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Only one request is in flight at a time, so the
+	// goroutine sending it never blocks on the channel.
+	replies := make(chan error, 1)
+	var pending bool
+	var missed int
+
+	for {
+		select {
+		case <-stop:
+			return true
+		case err := <-replies:
+			// Any reply, even a failure, means the peer is alive.
+			if err != nil {
+				return false
+			}
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			if pending {
+				missed++
+				if missed >= maxMissed {
+					return false
+				}
+				continue
+			}
+			pending = true
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+		}
+	}
+}
+
+// activityReader records the time of the last read returning data.
+type activityReader struct {
+	r    io.Reader
+	last int64 // unix nanoseconds of the last read, accessed atomically
+}
+
+func newActivityReader(r io.Reader) *activityReader {
+	return &activityReader{r: r, last: time.Now().UnixNano()}
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&a.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// idle returns for how long no data has been read.
+func (a *activityReader) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// waitIdle waits until nothing has been read from the reader for timeout
+// and returns true, or returns false once stop is closed.
+func waitIdle(a *activityReader, timeout time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-timer.C:
+			idle := a.idle()
+			if idle >= timeout {
+				return true
+			}
+			timer.Reset(timeout - idle)
+		}
+	}
+}
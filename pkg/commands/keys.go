@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"context"
+
+	"github.com/gusmin/gate/pkg/core"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// newKeysCommand creates a new "keys" command tied to the given core.
+func newKeysCommand(core *core.SecureGateCore) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys",
+		Short: core.Translator.Translate("KeysShortDesc"),
+		Long:  core.Translator.Translate("KeysShortDesc"),
+	}
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:          "rotate",
+			Short:        core.Translator.Translate("KeysRotateShortDesc"),
+			Long:         core.Translator.Translate("KeysRotateShortDesc"),
+			SilenceUsage: true,
+			Args:         cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				ctx, cancel := withInterrupt(context.Background())
+				defer cancel()
+
+				err := core.RotateSSHKey(ctx)
+				if err != nil {
+					return err
+				}
+				core.Logger.WithFields(logrus.Fields{
+					"user": core.User().ID,
+				}).Infof(core.Translator.Translate("KeyRotated"), core.KeyFingerprint())
+				return nil
+			},
+		},
+	)
+
+	return cmd
+}
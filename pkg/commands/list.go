@@ -38,6 +38,7 @@ func list(
 		translator.Translate("Name"),
 		translator.Translate("IP"),
 		translator.Translate("AgentPort"),
+		translator.Translate("SSHPort"),
 	})
 	table.SetCaption(true, translator.Translate("ListCaption"))
 
@@ -48,6 +49,7 @@ func list(
 			machine.Name,
 			machine.IP,
 			strconv.Itoa(machine.AgentPort),
+			strconv.Itoa(machine.SSHPort),
 		})
 	}
 
@@ -0,0 +1,280 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/core"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// newPexecCommand creates a new "pexec" command tied to the given core.
+func newPexecCommand(core *core.SecureGateCore) *cobra.Command {
+	var (
+		all     bool
+		glob    string
+		ids     string
+		workers int
+		timeout time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:          "pexec [--all | --glob pattern | --ids id,...] -- [command]",
+		Short:        core.Translator.Translate("PexecShortDesc"),
+		Long:         core.Translator.Translate("PexecShortDesc"),
+		SilenceUsage: true,
+		Args:         cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			machines, err := selectMachines(core.Machines(), all, glob, ids)
+			if err != nil {
+				return err
+			}
+			if workers < 1 {
+				return fmt.Errorf("invalid number of workers: %d", workers)
+			}
+
+			ctx, cancel := withInterrupt(context.Background())
+			defer cancel()
+
+			results := fanOut(ctx, core, machines, strings.Join(args, " "), workers, timeout)
+			fanOutSummary(core.User(), results, core.Logger, core.Translator)
+
+			var failures int
+			for _, res := range results {
+				if res.err != nil {
+					failures++
+				}
+			}
+			if failures > 0 {
+				return fmt.Errorf("command failed on %d of %d machines", failures, len(results))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&all, "all", "a", false, core.Translator.Translate("PexecAllFlag"))
+	cmd.Flags().StringVarP(&glob, "glob", "g", "", core.Translator.Translate("PexecGlobFlag"))
+	cmd.Flags().StringVarP(&ids, "ids", "i", "", core.Translator.Translate("PexecIDsFlag"))
+	cmd.Flags().IntVarP(&workers, "workers", "w", 10, core.Translator.Translate("PexecWorkersFlag"))
+	cmd.Flags().DurationVarP(&timeout, "timeout", "t", 5*time.Minute, core.Translator.Translate("PexecTimeoutFlag"))
+
+	return cmd
+}
+
+// selectMachines returns the accessible machines targeted either by all,
+// by a glob on their name or by a comma separated list of IDs.
+func selectMachines(machines []backend.Machine, all bool, glob, ids string) ([]backend.Machine, error) {
+	var selectors int
+	for _, set := range []bool{all, glob != "", ids != ""} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		return nil, errors.New("exactly one of --all, --glob or --ids is required")
+	}
+
+	var selected []backend.Machine
+	switch {
+	case all:
+		selected = machines
+	case glob != "":
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid glob %s", glob)
+		}
+		for _, m := range machines {
+			if ok, _ := path.Match(glob, m.Name); ok {
+				selected = append(selected, m)
+			}
+		}
+	default:
+		byID := make(map[string]backend.Machine)
+		for _, m := range machines {
+			byID[m.ID] = m
+		}
+		for _, id := range strings.Split(ids, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				continue
+			}
+			m, ok := byID[id]
+			if !ok {
+				return nil, fmt.Errorf("%s is not part of accessible machines", id)
+			}
+			selected = append(selected, m)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, errors.New("no accessible machine selected")
+	}
+	return selected, nil
+}
+
+// fanOutResult is the result of a command run on one machine.
+type fanOutResult struct {
+	machine  backend.Machine
+	status   int // exit status, -1 if the command did not complete
+	duration time.Duration
+	err      error
+}
+
+// fanOut runs the command on every machine with at most workers concurrent
+// executions, each one bounded by timeout. Output lines are prefixed with
+// the name of the machine they come from.
+func fanOut(ctx context.Context, core *core.SecureGateCore, machines []backend.Machine, command string, workers int, timeout time.Duration) []fanOutResult {
+	results := make([]fanOutResult, len(machines))
+	stdout := &syncWriter{w: os.Stdout}
+	stderr := &syncWriter{w: os.Stderr}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(machines); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = runOn(ctx, core, machines[i], command, timeout, stdout, stderr)
+			}
+		}()
+	}
+	for i := range machines {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// runOn runs the command on a single machine of a fan-out.
+func runOn(ctx context.Context, core *core.SecureGateCore, machine backend.Machine, command string, timeout time.Duration, stdout, stderr io.Writer) fanOutResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	prefix := "[" + machine.Name + "] "
+	outWriter := &prefixWriter{prefix: prefix, w: stdout}
+	errWriter := &prefixWriter{prefix: prefix, w: stderr}
+
+	start := time.Now()
+	err := execute(ctx, core, machine, command, outWriter, errWriter)
+	outWriter.Flush()
+	errWriter.Flush()
+
+	res := fanOutResult{
+		machine:  machine,
+		duration: time.Since(start),
+		err:      err,
+	}
+	switch err := err.(type) {
+	case nil:
+		res.status = 0
+	case *ExitStatusError:
+		res.status = err.Status
+	default:
+		res.status = -1
+	}
+	return res
+}
+
+// fanOutSummary displays the result of a fan-out with the logger in a table.
+func fanOutSummary(user backend.User, results []fanOutResult, logger *logrus.Logger, translator core.Translator) {
+	var sb strings.Builder
+
+	// Write table into the string.Builder.
+	table := tablewriter.NewWriter(&sb)
+	table.SetHeader([]string{
+		translator.Translate("ID"),
+		translator.Translate("Name"),
+		translator.Translate("ExitStatus"),
+		translator.Translate("Duration"),
+		translator.Translate("Error"),
+	})
+	table.SetCaption(true, translator.Translate("PexecCaption"))
+
+	// Fill the table.
+	for _, res := range results {
+		status := "-"
+		if res.status >= 0 {
+			status = strconv.Itoa(res.status)
+		}
+		var errMsg string
+		if _, ok := res.err.(*ExitStatusError); res.err != nil && !ok {
+			errMsg = res.err.Error()
+		}
+		table.Append([]string{
+			res.machine.ID,
+			res.machine.Name,
+			status,
+			res.duration.Round(time.Millisecond).String(),
+			errMsg,
+		})
+	}
+
+	// Render the table into the string.Builder.
+	table.Render()
+
+	logger.WithFields(logrus.Fields{
+		"user": user.ID,
+	}).Infof(sb.String())
+}
+
+// syncWriter serializes writes to the underlying writer.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// prefixWriter bufferize written bytes until a new line,
+// then writes the line preceded by the prefix.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	buffer []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+
+	for {
+		i := bytes.IndexByte(w.buffer, '\n')
+		if i < 0 {
+			break
+		}
+		line := append([]byte(w.prefix), w.buffer[:i+1]...)
+		if _, err := w.w.Write(line); err != nil {
+			return 0, err
+		}
+		w.buffer = w.buffer[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the buffered bytes not terminated by a new line.
+func (w *prefixWriter) Flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	line := append([]byte(w.prefix), w.buffer...)
+	w.buffer = nil
+	_, err := w.w.Write(append(line, '\n'))
+	return err
+}
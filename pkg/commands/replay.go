@@ -0,0 +1,194 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/core"
+	"github.com/gusmin/gate/pkg/database"
+	"github.com/gusmin/gate/pkg/recording"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// newReplayCommand creates a new "replay" command tied to the given core.
+func newReplayCommand(core *core.SecureGateCore) *cobra.Command {
+	var (
+		speed   float64
+		maxIdle time.Duration
+		machine string
+	)
+
+	cmd := &cobra.Command{
+		Use:          "replay [session-id]",
+		Short:        core.Translator.Translate("ReplayShortDesc"),
+		Long:         core.Translator.Translate("ReplayShortDesc"),
+		SilenceUsage: true,
+		Args:         cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				var machineID string
+				if machine != "" {
+					m, err := findMachine(machine, core.Machines(), core.Translator)
+					if err != nil {
+						return err
+					}
+					machineID = m.ID
+				}
+				recordings, err := core.DB.Recordings(core.User().ID, machineID)
+				if err != nil {
+					return errors.Wrap(err, "could not retrieve recordings")
+				}
+				listRecordings(core.User(), core.Machines(), recordings, core.Logger, core.Translator)
+				return nil
+			}
+
+			ctx, cancel := withInterrupt(context.Background())
+			defer cancel()
+
+			return replay(ctx, core, args[0], os.Stdout, speed, maxIdle)
+		},
+	}
+	cmd.Flags().Float64VarP(&speed, "speed", "s", 1, core.Translator.Translate("ReplaySpeedFlag"))
+	cmd.Flags().DurationVar(&maxIdle, "max-idle", 2*time.Second, core.Translator.Translate("ReplayMaxIdleFlag"))
+	cmd.Flags().StringVarP(&machine, "machine", "m", "", core.Translator.Translate("ReplayMachineFlag"))
+
+	return cmd
+}
+
+// replay plays the recording of one of the user's sessions back to w.
+func replay(ctx context.Context, core *core.SecureGateCore, sessionID string, w io.Writer, speed float64, maxIdle time.Duration) error {
+	user := core.User()
+
+	rec, err := core.DB.GetRecording(sessionID)
+	if err != nil || rec.UserID != user.ID {
+		return fmt.Errorf(core.Translator.Translate("NotRecordedSession"), sessionID)
+	}
+
+	f, err := os.Open(rec.Path)
+	if err != nil {
+		return errors.Wrapf(err, core.Translator.Translate("RecordingUnreadable"), sessionID)
+	}
+	defer f.Close()
+
+	core.Logger.WithFields(logrus.Fields{
+		"user":    user.ID,
+		"machine": rec.MachineID,
+		"account": rec.Account,
+		"session": sessionID,
+	}).Warnf(core.Translator.Translate("SessionReplayed"), sessionID)
+
+	err = recording.Play(ctx, f, w, speed, maxIdle)
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+// listRecordings lists recorded sessions with the logger in a table.
+func listRecordings(
+	user backend.User,
+	machines []backend.Machine,
+	recordings []database.Recording,
+	logger *logrus.Logger, translator core.Translator) {
+
+	names := make(map[string]string)
+	for _, m := range machines {
+		names[m.ID] = m.Name
+	}
+
+	var sb strings.Builder
+
+	// Write table into the string.Builder.
+	table := tablewriter.NewWriter(&sb)
+	table.SetHeader([]string{
+		translator.Translate("ID"),
+		translator.Translate("Machine"),
+		translator.Translate("Account"),
+		translator.Translate("Start"),
+	})
+	table.SetCaption(true, translator.Translate("RecordingsCaption"))
+
+	// Fill the table.
+	for _, rec := range recordings {
+		machine := names[rec.MachineID]
+		if machine == "" {
+			machine = rec.MachineID
+		}
+		table.Append([]string{
+			rec.ID,
+			machine,
+			rec.Account,
+			rec.Start.Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	// Render the table into the string.Builder.
+	table.Render()
+
+	logger.WithFields(logrus.Fields{
+		"user": user.ID,
+	}).Infof(sb.String())
+}
+
+// startRecording creates the asciicast file of the session in the configured
+// recordings directory and indexes it in the database. The returned function
+// must be called to close the recording once the session is over.
+func startRecording(core *core.SecureGateCore, machine backend.Machine, sessionID string, width, height int) (*recording.Recorder, func() error, error) {
+	if core.Config.RecordingsDir == "" {
+		return nil, nil, errors.New("no directory configured to store recordings")
+	}
+	user := core.User()
+
+	dir := filepath.Join(core.Config.RecordingsDir, user.ID)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create recordings directory")
+	}
+
+	path := filepath.Join(dir, sessionID+".cast")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create recording file")
+	}
+
+	recorder, err := recording.NewRecorder(f, recording.Header{
+		Width:  width,
+		Height: height,
+		Title:  user.ID + "@" + machine.Name,
+		Env:    map[string]string{"TERM": "xterm-256color"},
+	})
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	err = core.DB.AddRecording(database.Recording{
+		ID:        sessionID,
+		UserID:    user.ID,
+		MachineID: machine.ID,
+		Account:   core.Account(machine),
+		Start:     time.Now(),
+		Path:      path,
+	})
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "could not index recording")
+	}
+
+	return recorder, func() error {
+		err := recorder.Close()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,45 @@
+// +build !windows
+
+package commands
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// watchWindowSize calls onResize with the new size of the terminal
+// every time it is resized until the returned function is called.
+func watchWindowSize(termFD int, onResize func(width, height int)) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+
+	done := make(chan struct{})
+	go func() {
+		lastWidth, lastHeight, _ := terminal.GetSize(termFD)
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigs:
+				width, height, err := terminal.GetSize(termFD)
+				if err != nil {
+					continue
+				}
+				// Several signals can be received for the same size.
+				if width == lastWidth && height == lastHeight {
+					continue
+				}
+				lastWidth, lastHeight = width, height
+				onResize(width, height)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,7 @@
+package commands
+
+// watchWindowSize does nothing on Windows where
+// terminals are not resized through signals.
+func watchWindowSize(termFD int, onResize func(width, height int)) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,382 @@
+package commands
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gusmin/gate/pkg/core"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// newPutCommand creates a new "put" command tied to the given core.
+func newPutCommand(core *core.SecureGateCore) *cobra.Command {
+	var recursive bool
+
+	cmd := &cobra.Command{
+		Use:          "put [machine] [local path] [remote path]",
+		Short:        core.Translator.Translate("PutShortDesc"),
+		Long:         core.Translator.Translate("PutShortDesc"),
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withTransfer(core, args[0], func(t *transfer) error {
+				return t.put(args[1], args[2], recursive)
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&recursive, "recursive", "r", false, core.Translator.Translate("RecursiveFlag"))
+
+	return cmd
+}
+
+// newGetCommand creates a new "get" command tied to the given core.
+func newGetCommand(core *core.SecureGateCore) *cobra.Command {
+	var recursive bool
+
+	cmd := &cobra.Command{
+		Use:          "get [machine] [remote path] [local path]",
+		Short:        core.Translator.Translate("GetShortDesc"),
+		Long:         core.Translator.Translate("GetShortDesc"),
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withTransfer(core, args[0], func(t *transfer) error {
+				return t.get(args[1], args[2], recursive)
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&recursive, "recursive", "r", false, core.Translator.Translate("RecursiveFlag"))
+
+	return cmd
+}
+
+// withTransfer opens an SFTP session with the machine and calls fn with it.
+func withTransfer(core *core.SecureGateCore, machineName string, fn func(t *transfer) error) error {
+	machine, err := findMachine(machineName, core.Machines(), core.Translator)
+	if err != nil {
+		return err
+	}
+
+	if core.Config.TransfersDir == "" {
+		return errors.New("no directory configured for transfers")
+	}
+	root := filepath.Join(core.Config.TransfersDir, core.User().ID)
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return errors.Wrap(err, "could not create transfer directory")
+	}
+
+	// Connect to the server, reusing the connection of a previous command
+	conn, err := core.Connect(context.Background(), machine)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	client, err := sftp.NewClient(conn.Client)
+	if err != nil {
+		return errors.Wrap(err, "could not open SFTP session")
+	}
+	defer client.Close()
+
+	return fn(&transfer{
+		client: client,
+		root:   root,
+		logFn: core.Logger.WithFields(logrus.Fields{
+			"user":    core.User().ID,
+			"machine": machine.ID,
+			"account": core.Account(machine),
+			"session": newSessionID(),
+		}),
+		progress: os.Stdout,
+		maxSize:  core.Config.TransferMaxSize,
+	})
+}
+
+// transfer copies files between the gate and a machine over SFTP.
+// Local files are confined to the transfer directory of the user.
+// Every copied file is audited with its size and SHA-256 checksum.
+type transfer struct {
+	client   *sftp.Client
+	root     string // transfer directory of the user
+	logFn    *logrus.Entry
+	progress io.Writer // where the progress is displayed
+	maxSize  int64     // maximum size of a transfer in bytes, unlimited if not positive
+	copied   int64     // bytes copied by the current put or get
+}
+
+// put uploads the local file, or directory if recursive, to the remote path.
+func (t *transfer) put(local, remote string, recursive bool) error {
+	t.copied = 0
+	local, err := t.localPath(local)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		return errors.Wrapf(err, "could not stat %s", local)
+	}
+	if info.IsDir() && !recursive {
+		return fmt.Errorf("%s is a directory (use -r)", local)
+	}
+
+	// Copy inside the remote path if it is an existing directory.
+	if rinfo, err := t.client.Stat(remote); err == nil && rinfo.IsDir() {
+		remote = path.Join(remote, filepath.Base(local))
+	}
+
+	var size int64
+	err = filepath.Walk(local, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing symbolic link %s", p)
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not walk %s", local)
+	}
+	if err := t.checkSize(size); err != nil {
+		return err
+	}
+
+	return filepath.Walk(local, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		dst := path.Join(remote, filepath.ToSlash(rel))
+
+		switch {
+		case info.IsDir():
+			return t.client.MkdirAll(dst)
+		case info.Mode().IsRegular():
+			src, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			f, err := t.client.Create(dst)
+			if err != nil {
+				return errors.Wrapf(err, "could not create remote file %s", dst)
+			}
+			defer f.Close()
+			return t.copy("put", p, dst, f, src, info.Size())
+		default:
+			// Special files are not transferred.
+			return nil
+		}
+	})
+}
+
+// get downloads the remote file, or directory if recursive, to the local path.
+func (t *transfer) get(remote, local string, recursive bool) error {
+	t.copied = 0
+	info, err := t.client.Stat(remote)
+	if err != nil {
+		return errors.Wrapf(err, "could not stat remote %s", remote)
+	}
+	if info.IsDir() && !recursive {
+		return fmt.Errorf("%s is a directory (use -r)", remote)
+	}
+
+	local, err = t.localPath(local)
+	if err != nil {
+		return err
+	}
+	// Copy inside the local path if it is an existing directory.
+	if linfo, err := os.Stat(local); err == nil && linfo.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+
+	var size int64
+	walker := t.client.Walk(remote)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return errors.Wrapf(err, "could not walk remote %s", remote)
+		}
+		if walker.Stat().Mode().IsRegular() {
+			size += walker.Stat().Size()
+		}
+	}
+	if err := t.checkSize(size); err != nil {
+		return err
+	}
+
+	walker = t.client.Walk(remote)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return errors.Wrapf(err, "could not walk remote %s", remote)
+		}
+		rel, err := filepath.Rel(remote, walker.Path())
+		if err != nil {
+			return err
+		}
+		// Names given by the machine must not lead out of the transfer directory.
+		dst := filepath.Join(local, rel)
+		if err := t.checkLocal(dst); err != nil {
+			return err
+		}
+
+		info := walker.Stat()
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := t.getFile(walker.Path(), dst, info.Size()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// localPath returns the path of the local file p given by the user
+// in the transfer directory.
+func (t *transfer) localPath(p string) (string, error) {
+	if filepath.IsAbs(p) {
+		return "", fmt.Errorf("%s is not relative to your transfer directory", p)
+	}
+	p = filepath.Clean(p)
+	if p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of your transfer directory", p)
+	}
+
+	local := filepath.Join(t.root, p)
+	if err := t.checkLocal(local); err != nil {
+		return "", err
+	}
+	return local, nil
+}
+
+// checkLocal checks that the local path is in the transfer directory and
+// that none of its existing components is a symbolic link leading elsewhere.
+func (t *transfer) checkLocal(local string) error {
+	rel, err := filepath.Rel(t.root, local)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of your transfer directory", local)
+	}
+	if rel == "." {
+		return nil
+	}
+
+	p := t.root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, name)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing symbolic link %s", p)
+		}
+	}
+	return nil
+}
+
+// getFile downloads a single remote file.
+func (t *transfer) getFile(remote, local string, size int64) error {
+	src, err := t.client.Open(remote)
+	if err != nil {
+		return errors.Wrapf(err, "could not open remote file %s", remote)
+	}
+	defer src.Close()
+
+	f, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return t.copy("get", remote, local, f, src, size)
+}
+
+// checkSize checks the size of a transfer against the configured limit.
+func (t *transfer) checkSize(size int64) error {
+	if t.maxSize > 0 && size > t.maxSize {
+		return fmt.Errorf("transfer of %d bytes exceeds the limit of %d bytes", size, t.maxSize)
+	}
+	return nil
+}
+
+// copy copies src to dst displaying the progress and audits the transfer.
+// Sizes announced beforehand may be wrong or files may grow meanwhile,
+// so the limit of the transfer is enforced on the bytes actually copied.
+func (t *transfer) copy(op, from, to string, dst io.Writer, src io.Reader, size int64) error {
+	hash := sha256.New()
+	progress := &progressWriter{w: t.progress, name: from, total: size}
+
+	remaining := t.maxSize - t.copied
+	if t.maxSize > 0 {
+		src = io.LimitReader(src, remaining+1)
+	}
+	n, err := io.Copy(io.MultiWriter(dst, hash, progress), src)
+	progress.Done()
+	t.copied += n
+	if err == nil && t.maxSize > 0 && n > remaining {
+		err = fmt.Errorf("transfer exceeds the limit of %d bytes", t.maxSize)
+	}
+	if err != nil {
+		t.logFn.Warnf("%s %s -> %s failed after %d bytes: %v\n", op, from, to, n, err)
+		return errors.Wrapf(err, "could not copy %s", from)
+	}
+
+	t.logFn.Warnf("%s %s -> %s (%d bytes, sha256 %s)\n", op, from, to, n, hex.EncodeToString(hash.Sum(nil)))
+	return nil
+}
+
+// progressWriter displays the progress of bytes written to it on one line.
+type progressWriter struct {
+	w       io.Writer
+	name    string
+	total   int64
+	written int64
+	last    time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	// Avoid flooding the terminal.
+	if time.Since(p.last) > 100*time.Millisecond {
+		p.last = time.Now()
+		p.print()
+	}
+	return len(b), nil
+}
+
+// Done displays the final progress and ends the line.
+func (p *progressWriter) Done() {
+	p.print()
+	fmt.Fprint(p.w, "\n")
+}
+
+func (p *progressWriter) print() {
+	percent := int64(100)
+	if p.total > 0 {
+		percent = p.written * 100 / p.total
+	}
+	fmt.Fprintf(p.w, "\r%s %3d%% %d/%d bytes", p.name, percent, p.written, p.total)
+}
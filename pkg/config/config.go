@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
@@ -17,6 +18,58 @@ type Configuration struct {
 	AgentAuthToken string `mapstructure:"agent_authentication_token"`
 	Language       string `mapstructure:"language"`
 	DBPath         string `mapstructure:"db_path"`
+	RecordingsDir  string `mapstructure:"recordings_dir"`
+	// Maximum size in bytes of a file transfer, unlimited if not positive
+	TransferMaxSize int64 `mapstructure:"transfer_max_size"`
+	// Directory holding a directory per user, the only local files put and get can access
+	TransfersDir string `mapstructure:"transfers_dir"`
+	// Interval between SSH keepalives, disabled if not positive
+	KeepaliveInterval time.Duration `mapstructure:"keepalive_interval"`
+	// Number of unanswered keepalives in a row before disconnecting
+	KeepaliveMaxMissed int `mapstructure:"keepalive_max_missed"`
+	// Duration without input after which a session is closed, disabled if not positive
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// Regular expressions of secrets masked in audit logs, in addition to the built-in ones
+	RedactionRules []string `mapstructure:"redaction_rules"`
+	// Duration an unused SSH connection is kept to be reused, never kept if not positive
+	ConnectionIdleTimeout time.Duration `mapstructure:"connection_idle_timeout"`
+	// Escape character of connect sessions, "none" to disable escape sequences
+	EscapeChar string `mapstructure:"escape_char"`
+	// Type of the SSH keys generated for users: "ed25519", "rsa" or "ecdsa"
+	KeyType string `mapstructure:"key_type"`
+	// Age after which the SSH key of a user is rotated, never rotated if not positive
+	KeyMaxAge time.Duration `mapstructure:"key_max_age"`
+	// Private key of the certificate authority signing user certificates, disabled if empty
+	CAKeyPath string `mapstructure:"ca_key_path"`
+	// Validity of the user certificates
+	CertificateValidity time.Duration `mapstructure:"certificate_validity"`
+	// Encryption of the private keys at rest: "none", "master_key" or "password"
+	KeyEncryption string `mapstructure:"key_encryption"`
+	// File only readable by its owner holding the master key encrypting private keys
+	MasterKeyPath string `mapstructure:"master_key_path"`
+	// Store of the SSH key pairs of the users: "file" or "bolt"
+	KeyStore string `mapstructure:"key_store"`
+	// Directory or database file of the key store, its default location if empty
+	KeyStorePath string `mapstructure:"key_store_path"`
+	// Generate a key at each login, revoked at logout, instead of keeping one per user
+	EphemeralKeys bool `mapstructure:"ephemeral_keys"`
+	// Source of the SSH keys of the users: "store", "ssh_agent" or "signer"
+	KeySource string `mapstructure:"key_source"`
+	// Socket of the external signing helper, speaking the ssh-agent protocol
+	SignerSocket string `mapstructure:"signer_socket"`
+	// SHA256 fingerprint of the key to use among the ones of the agent, the first one if empty
+	KeyFingerprint string `mapstructure:"key_fingerprint"`
+	// Scheme of the agents API when the backend gives none: "https" or "http"
+	AgentScheme string `mapstructure:"agent_scheme"`
+	// Allow plain HTTP with the agents, exposing the token and keys on the network
+	AgentInsecure bool `mapstructure:"agent_insecure"`
+	// CA bundle verifying the agents certificates, the system roots if empty
+	AgentCAFile string `mapstructure:"agent_ca_file"`
+	// Client certificate and key presented to the agents requiring mutual TLS
+	AgentCertFile string `mapstructure:"agent_cert_file"`
+	AgentKeyFile  string `mapstructure:"agent_key_file"`
+	// Pins of the agents certificates by machine ID, as "sha256/" and the base64 hash of their public key
+	AgentCertPins map[string]string `mapstructure:"agent_cert_pins"`
 }
 
 // Debug prints the given configuration struct.
@@ -60,4 +113,22 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("ssh_user", "secure")
 	v.SetDefault("language", "en")
 	v.SetDefault("db_path", "/var/lib/securegate/gate/securegate.db")
+	v.SetDefault("recordings_dir", "/var/lib/securegate/gate/recordings")
+	v.SetDefault("transfer_max_size", 100*1024*1024)
+	v.SetDefault("transfers_dir", "/var/lib/securegate/gate/transfers")
+	v.SetDefault("keepalive_interval", "15s")
+	v.SetDefault("keepalive_max_missed", 3)
+	v.SetDefault("idle_timeout", "0s")
+	v.SetDefault("connection_idle_timeout", "5m")
+	v.SetDefault("escape_char", "~")
+	v.SetDefault("key_type", "ed25519")
+	v.SetDefault("key_max_age", "2160h")
+	v.SetDefault("certificate_validity", "5m")
+	v.SetDefault("key_encryption", "none")
+	v.SetDefault("master_key_path", "/etc/securegate/gate/master.key")
+	v.SetDefault("key_store", "file")
+	v.SetDefault("ephemeral_keys", false)
+	v.SetDefault("key_source", "store")
+	v.SetDefault("agent_scheme", "https")
+	v.SetDefault("agent_insecure", false)
 }
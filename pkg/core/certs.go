@@ -0,0 +1,84 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultCertificateValidity is how long user certificates are valid
+// when no validity is configured.
+const DefaultCertificateValidity = 5 * time.Minute
+
+// certificateClockSkew backdates the certificates to tolerate
+// clocks of machines running a little late.
+const certificateClockSkew = time.Minute
+
+// LoadCertificateAuthority loads the private key of the certificate
+// authority signing the user certificates.
+func LoadCertificateAuthority(keyPath string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load certificate authority")
+	}
+	ca, err := parsePrivateKeySigner(b, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load certificate authority")
+	}
+	return ca, nil
+}
+
+// certificateSigner returns a signer authenticating with a short-lived
+// certificate of the user key, signed by the certificate authority, which
+// lets the user log in as his account on the machine. The serial of the
+// certificate is logged to be matched with the logs of the machine.
+func (core *SecureGateCore) certificateSigner(signer ssh.Signer, machine backend.Machine) (ssh.Signer, error) {
+	validity := core.Config.CertificateValidity
+	if validity <= 0 {
+		validity = DefaultCertificateValidity
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, errors.Wrap(err, "could not generate certificate serial")
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           core.User().ID,
+		ValidPrincipals: []string{core.Account(machine)},
+		ValidAfter:      uint64(now.Add(-certificateClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":             "",
+				"permit-port-forwarding": "",
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, core.CA); err != nil {
+		return nil, errors.Wrap(err, "could not sign user certificate")
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not use user certificate")
+	}
+
+	core.Logger.WithFields(logrus.Fields{
+		"user":    core.User().ID,
+		"machine": machine.ID,
+		"account": core.Account(machine),
+	}).Warnf("Issued certificate %d for %s valid until %s\n",
+		cert.Serial, machine.Name, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	return certSigner, nil
+}
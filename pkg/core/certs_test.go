@@ -0,0 +1,83 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+func TestCertificateSigner(t *testing.T) {
+	assert := require.New(t)
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+
+	core := New(
+		"secure",
+		nil,
+		nil,
+		logger,
+		&mockTranslator{},
+		&mockDatabaseRepository{},
+	)
+	core.CA = newSigner(t)
+	core.Config = config.Configuration{CertificateValidity: 2 * time.Minute}
+	core.session.user.set(backend.User{ID: "foobar"})
+
+	userSigner := newSigner(t)
+	machine := backend.Machine{ID: "1", Name: "web", Account: "deploy"}
+	signer, err := core.certificateSigner(userSigner, machine)
+	assert.NoError(err)
+
+	cert, ok := signer.PublicKey().(*ssh.Certificate)
+	assert.True(ok)
+	assert.Equal(userSigner.PublicKey().Marshal(), cert.Key.Marshal())
+	assert.Equal(uint32(ssh.UserCert), cert.CertType)
+	assert.Equal("foobar", cert.KeyId)
+	assert.Equal([]string{"deploy"}, cert.ValidPrincipals)
+	assert.InDelta(time.Now().Add(2*time.Minute).Unix(), int64(cert.ValidBefore), 5)
+	assert.Contains(logs.String(), "Issued certificate")
+
+	// Nodes trusting the CA accept it for the account only
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), core.CA.PublicKey().Marshal())
+		},
+	}
+	_, err = checker.Authenticate(connMetadata{user: "deploy"}, cert)
+	assert.NoError(err)
+	_, err = checker.Authenticate(connMetadata{user: "root"}, cert)
+	assert.Error(err)
+
+	// Every certificate has its own serial
+	other, err := core.certificateSigner(userSigner, machine)
+	assert.NoError(err)
+	assert.NotEqual(cert.Serial, other.PublicKey().(*ssh.Certificate).Serial)
+}
+
+// connMetadata is the metadata of a connection authenticating as user.
+type connMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (m connMetadata) User() string {
+	return m.user
+}
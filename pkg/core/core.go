@@ -3,24 +3,26 @@ package core
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gusmin/gate/pkg/agent"
 	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/config"
 	"github.com/gusmin/gate/pkg/database"
+	"github.com/gusmin/gate/pkg/redact"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
 var (
-	// secureGateKeysDir is the directory used to store SSH key pairs for users.
+	// secureGateKeysDir is the default directory used to store SSH key pairs for users.
 	secureGateKeysDir = path.Join(os.Getenv("HOME"), ".sgsh")
 )
 
@@ -38,10 +40,25 @@ type SecureGateCore struct {
 	Logger *logrus.Logger
 	// Translator for app internationalization
 	Translator Translator
+	// Configuration of the gate
+	Config config.Configuration
+	// Redactor masking secrets in audit logs
+	Redactor *redact.Redactor
+	// Certificate authority signing user certificates for each connection,
+	// user keys are registered in agents instead if nil
+	CA ssh.Signer
+	// Store of the SSH key pairs of the users
+	Keys KeyStore
 
 	// contains filtered or unexported fields
-	loggedIn          bool    // set to true after successful SignUp
-	session           session // updated by background polling
+	loggedIn          bool           // set to true after successful SignUp
+	session           session        // updated by background polling
+	pool              *connPool      // SSH connections reused across commands
+	keysMu            sync.Mutex     // serializes key rotations and agents updates
+	rotating          int32          // set while checking for a key rotation, accessed atomically
+	reports           sync.WaitGroup // session events being reported
+	reportsMu         sync.Mutex     // protects lastReport
+	lastReport        chan struct{}  // closed once the last reported event is sent
 	stopPoll          chan struct{}
 	stopPollListening chan struct{}
 }
@@ -58,6 +75,32 @@ type DatabaseRepository interface {
 	UpsertUser(user database.User) error
 	// FindUser returns the user in the database with the given userID.
 	GetUser(userID string) (database.User, error)
+	// UpsertHostKey update the machine host key in the database or insert it if none already exists.
+	UpsertHostKey(hostKey database.HostKey) error
+	// GetHostKey returns the host key pinned for the given machineID.
+	GetHostKey(machineID string) (database.HostKey, error)
+	// DeleteHostKey removes the host key pinned for the given machineID.
+	DeleteHostKey(machineID string) error
+	// HostKeys returns every pinned host key.
+	HostKeys() ([]database.HostKey, error)
+	// AddRecording indexes a session recording.
+	AddRecording(recording database.Recording) error
+	// GetRecording returns the session recording with the given ID.
+	GetRecording(id string) (database.Recording, error)
+	// Recordings returns the recordings of the user on the machine sorted by start time.
+	Recordings(userID, machineID string) ([]database.Recording, error)
+	// UpsertKeyRotation update the key rotation of the user in the database or insert it if none already exists.
+	UpsertKeyRotation(rotation database.KeyRotation) error
+	// GetKeyRotation returns the unfinished key rotation of the given userID.
+	GetKeyRotation(userID string) (database.KeyRotation, error)
+	// DeleteKeyRotation removes the key rotation of the given userID.
+	DeleteKeyRotation(userID string) error
+	// UpsertEphemeralKey update the ephemeral key in the database or insert it if none already exists.
+	UpsertEphemeralKey(key database.EphemeralKey) error
+	// EphemeralKeys returns the ephemeral keys not revoked yet.
+	EphemeralKeys() ([]database.EphemeralKey, error)
+	// DeleteEphemeralKey removes the ephemeral key of the given name.
+	DeleteEphemeralKey(name string) error
 }
 
 // BackendClient is a client which can interact with a Secure Gate server.
@@ -70,6 +113,8 @@ type BackendClient interface {
 	Me(ctx context.Context) (backend.MeResponse, error)
 	// AddMachineLog sends logs to the server.
 	AddMachineLog(ctx context.Context, inputs []backend.MachineLogInput) (backend.AddMachineLogResponse, error)
+	// AddSessionEvent sends the beginning or the end of a session to the server.
+	AddSessionEvent(ctx context.Context, input backend.SessionEventInput) (backend.AddSessionEventResponse, error)
 	// SetToken set the JWT which will be used for requests.
 	SetToken(token string)
 }
@@ -78,10 +123,10 @@ type BackendClient interface {
 type AgentClient interface {
 	// AddAuthorizedKey add a new authorized key for the user
 	// to the authorized_keys file in the agent running at the given endpoint.
-	AddAuthorizedKey(ctx context.Context, endpoint, id string, key []byte) (agent.SSHAuthResponse, error)
+	AddAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (agent.SSHAuthResponse, error)
 	// DeleteAuthorizedKey delete the user authorized key from
 	// the authorized_keys file in the agent running at the given endpoint.
-	DeleteAuthorizedKey(ctx context.Context, endpoint, id string, key []byte) (agent.SSHAuthResponse, error)
+	DeleteAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (agent.SSHAuthResponse, error)
 }
 
 // New creates a new Secure Gate core.
@@ -93,6 +138,9 @@ func New(sshUser string, backendClient BackendClient, agentClient AgentClient, l
 		DB:                repo,
 		Logger:            logger,
 		Translator:        translator,
+		Redactor:          redact.Default(),
+		Keys:              NewFileKeyStore(secureGateKeysDir),
+		pool:              newConnPool(),
 		stopPoll:          make(chan struct{}),
 		stopPollListening: make(chan struct{}),
 	}
@@ -111,7 +159,7 @@ func (core *SecureGateCore) SignUp(email, password string) error {
 	}
 	core.BackendClient.SetToken(resp.Auth.Token)
 
-	err = core.initUserSession()
+	err = core.initUserSession(password)
 	if err != nil {
 		return errors.Wrap(err, "could not initialize the user's session")
 	}
@@ -125,7 +173,8 @@ func (core *SecureGateCore) SignUp(email, password string) error {
 // retrieving the user related informations, generating SSH keypair
 // if none already exists, send them to accessible nodes agents
 // and start a background polling of user informations.
-func (core *SecureGateCore) initUserSession() error {
+// The password of the user may encrypt his private keys.
+func (core *SecureGateCore) initUserSession(password string) error {
 	ctx := context.Background()
 
 	// Update user's informations
@@ -146,20 +195,61 @@ func (core *SecureGateCore) initUserSession() error {
 		return err
 	}
 
+	// Private keys are decrypted in memory only
+	core.session.encryptionKey, err = core.keyEncryptionKey(user.ID, password)
+	if err != nil {
+		return err
+	}
+
 	// Check for existing SSH keys
-	userSSHDir := path.Join(secureGateKeysDir, user.ID)
-	if exist(userSSHDir) == false {
+	keys, err := core.Keys.Keys(user.ID)
+	if err != nil {
+		return errors.Wrap(err, "could not list ssh keys")
+	}
+	if core.keySource() != KeySourceStore {
+		// Use a key kept out of the gate
+		err := core.initExternalKey()
+		if err != nil {
+			return errors.Wrap(err, "failed to get ssh key from "+core.keySource())
+		}
+		err = core.retireStoredKeys(ctx)
+		if err != nil {
+			return err
+		}
+	} else if core.Config.EphemeralKeys {
+		// Generate a key for this session only
+		err := core.initEphemeralKey(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to init ephemeral ssh key")
+		}
+	} else if len(keys) == 0 {
 		// Generate new ones if they do not exist already
-		err := core.initSSHKeys(userSSHDir)
+		err := core.initSSHKeys()
 		if err != nil {
 			return errors.Wrap(err, "failed to init ssh keys")
 		}
+	} else {
+		// Replace outdated ones
+		err := core.migrateSSHKeys(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to migrate ssh keys")
+		}
+	}
+
+	// Encrypt the keys stored in plaintext so far
+	if core.session.encryptionKey != nil {
+		err := core.encryptSSHKeys(core.session.encryptionKey)
+		if err != nil {
+			return errors.Wrap(err, "failed to encrypt ssh keys")
+		}
 	}
 
 	// Load the user public key to send it to agents if needed
-	err = core.loadPublicSSHKey(userSSHDir)
-	if err != nil {
-		return errors.Wrap(err, "could not load public ssh key")
+	if !core.externalKey() {
+		err = core.loadPublicSSHKey(core.session.keyName)
+		if err != nil {
+			return errors.Wrap(err, "could not load public ssh key")
+		}
 	}
 
 	// Communicate user permissions changes to agents
@@ -168,8 +258,26 @@ func (core *SecureGateCore) initUserSession() error {
 		return err
 	}
 
+	// A key encrypted with a former password can not be used anymore
+	_, err = core.signer()
+	if err != nil {
+		logFn := core.Logger.WithFields(logrus.Fields{
+			"user": user.ID,
+		})
+		logFn.Warnf("Could not load SSH key, replacing it: %v\n", err)
+		if err := core.RotateSSHKey(ctx); err != nil {
+			logFn.Warnf("Could not rotate SSH key: %v\n", err)
+		}
+	}
+
+	// Rotate the user SSH key if too old or resume the unfinished rotation
+	err = core.rotateSSHKeyIfNeeded(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not check ssh key rotation")
+	}
+
 	// Poll accessible nodes and user's informations periodically
-	errC := make(chan error, 3)
+	errC := make(chan error, 4)
 	go poll(
 		time.Second*10,
 		errC,
@@ -178,6 +286,7 @@ func (core *SecureGateCore) initUserSession() error {
 		core.updateUser,
 		core.updateMachines,
 		core.updateAgents,
+		core.rotateSSHKeyIfNeeded,
 	)
 	go func(ctx context.Context) {
 		for {
@@ -200,47 +309,64 @@ func (core *SecureGateCore) initUserSession() error {
 	return nil
 }
 
-// initSSHKeys generate private and public SSH keys for the authenticated user.
-func (core *SecureGateCore) initSSHKeys(keysPath string) error {
-	err := os.MkdirAll(keysPath, os.ModePerm)
+// initSSHKeys generate private and public SSH keys of the configured type
+// for the authenticated user and set them as the keys of the session.
+func (core *SecureGateCore) initSSHKeys() error {
+	name, err := keyFileName(core.keyType())
 	if err != nil {
-		return errors.Wrap(err, "could not create directory to store ssh keys")
+		return err
 	}
-
-	privKeyPath := path.Join(keysPath, "id_rsa")
-	pubKeyPath := path.Join(keysPath, "id_rsa.pub")
-	err = generateSSHKeyPair(pubKeyPath, privKeyPath)
+	pair, err := generateSSHKeyPair(core.keyType(), core.session.encryptionKey)
 	if err != nil {
 		return errors.Wrap(err, "could not generate ssh key pair for this session")
 	}
+	err = core.Keys.Put(core.User().ID, name, pair)
+	if err != nil {
+		return errors.Wrap(err, "could not store ssh key pair")
+	}
+	core.session.keyName = name
 	return nil
 }
 
-// loadPublicSSHKey parse the public ssh key located in keysPath and
-// set the user public key to the parsed key if no error occured.
-func (core *SecureGateCore) loadPublicSSHKey(keysPath string) error {
-	key, err := ioutil.ReadFile(path.Join(keysPath, "id_rsa.pub"))
+// loadPublicSSHKey parse the public ssh key of the key pair stored under
+// name and set the user public key to the parsed key if no error occured.
+func (core *SecureGateCore) loadPublicSSHKey(name string) error {
+	pair, err := core.Keys.Get(core.User().ID, name)
 	if err != nil {
-		return errors.Wrap(err, "could not read public ssh key file")
+		return errors.Wrap(err, "could not read public ssh key")
 	}
 
 	// Check if the key is valid
-	_, _, _, _, err = ssh.ParseAuthorizedKey(key)
+	_, _, _, _, err = ssh.ParseAuthorizedKey(pair.PublicKey)
 	if err != nil {
 		return errors.Wrap(err, "could not parse authorized key")
 	}
 
-	core.session.pubKey = key
+	core.session.pubKey = pair.PublicKey
 	return nil
 }
 
 // registerKeyToAgent register the user SSH public key in a machine's agent.
 func (core *SecureGateCore) registerKeyInAgent(ctx context.Context, machine backend.Machine) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	pubKey, _ := core.session.key()
+	return core.sendKeyToAgent(ctx, machine, pubKey)
+}
+
+// sendKeyToAgent register the given SSH public key of the user in a machine's agent.
+func (core *SecureGateCore) sendKeyToAgent(ctx context.Context, machine backend.Machine, key []byte) error {
+	// Machines trust the certificate authority instead
+	if core.CA != nil {
+		return nil
+	}
+
+	endpoint, err := core.agentEndpoint(machine)
+	if err != nil {
+		return errors.Wrapf(err, "failed to send SSH keys to %s", machine.Name)
+	}
+	ctx, cancel := context.WithTimeout(core.agentContext(ctx, machine), time.Second*15)
 	defer cancel()
 
-	uri := net.JoinHostPort(machine.IP, strconv.Itoa(machine.AgentPort))
-	resp, err := core.AgentClient.AddAuthorizedKey(ctx, "http://"+uri, core.User().ID, core.session.pubKey)
+	resp, err := core.AgentClient.AddAuthorizedKey(ctx, endpoint, core.User().ID, core.Account(machine), key)
 	if err != nil {
 		return errors.Wrapf(err, "failed to send SSH keys to %s", machine.Name)
 	}
@@ -252,15 +378,26 @@ func (core *SecureGateCore) registerKeyInAgent(ctx context.Context, machine back
 
 // unregisterKeyToAgent unregister the user SSH public key in a machine's agent.
 func (core *SecureGateCore) unregisterKeyInAgent(ctx context.Context, machine backend.Machine) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	pubKey, _ := core.session.key()
+	return core.deleteKeyFromAgent(ctx, core.User().ID, machine, pubKey)
+}
+
+// deleteKeyFromAgent unregister the given SSH public key of the given user in a machine's agent.
+// The user is given explicitly since keys may be revoked before anyone logs in.
+func (core *SecureGateCore) deleteKeyFromAgent(ctx context.Context, userID string, machine backend.Machine, key []byte) error {
+	endpoint, err := core.agentEndpoint(machine)
+	if err != nil {
+		return errors.Wrapf(err, "failed to send SSH keys to %s", machine.Name)
+	}
+	ctx, cancel := context.WithTimeout(core.agentContext(ctx, machine), time.Second*15)
 	defer cancel()
 
-	uri := net.JoinHostPort(machine.IP, strconv.Itoa(machine.AgentPort))
 	resp, err := core.AgentClient.DeleteAuthorizedKey(
 		ctx,
-		"http://"+uri,
-		core.User().ID,
-		core.session.pubKey,
+		endpoint,
+		userID,
+		core.Account(machine),
+		key,
 	)
 	if err != nil {
 		return errors.Wrapf(err, "failed to send SSH keys to %s", machine.Name)
@@ -271,6 +408,42 @@ func (core *SecureGateCore) unregisterKeyInAgent(ctx context.Context, machine ba
 	return nil
 }
 
+// agentEndpoint returns the URL of the agent of the machine. Agents are
+// reached over HTTPS unless the machine or the configuration says
+// otherwise, plain HTTP being refused unless explicitly allowed.
+func (core *SecureGateCore) agentEndpoint(machine backend.Machine) (string, error) {
+	scheme := machine.AgentScheme
+	if scheme == "" {
+		scheme = core.Config.AgentScheme
+	}
+	switch scheme {
+	case "", "https":
+		scheme = "https"
+	case "http":
+		if !core.Config.AgentInsecure {
+			return "", errors.New("refusing plain HTTP with the agent, agent_insecure is not set")
+		}
+	default:
+		return "", fmt.Errorf("unsupported agent scheme %s", scheme)
+	}
+
+	return scheme + "://" + net.JoinHostPort(machine.IP, strconv.Itoa(machine.AgentPort)), nil
+}
+
+// agentContext returns a context requiring the agent of the machine
+// to present the certificate pinned for it, if any.
+func (core *SecureGateCore) agentContext(ctx context.Context, machine backend.Machine) context.Context {
+	// The configuration keys are lowercased
+	pin, ok := core.Config.AgentCertPins[machine.ID]
+	if !ok {
+		pin = core.Config.AgentCertPins[strings.ToLower(machine.ID)]
+	}
+	if pin == "" {
+		return ctx
+	}
+	return agent.WithCertificatePin(ctx, pin)
+}
+
 // updateMachines update the accessible nodes by newly retrieved machines
 // from the backend.
 func (core *SecureGateCore) updateMachines(ctx context.Context) error {
@@ -302,6 +475,9 @@ func (core *SecureGateCore) updateUser(ctx context.Context) error {
 // updateAgents update agents authorized_keys file depending on permissions
 // changes.
 func (core *SecureGateCore) updateAgents(ctx context.Context) error {
+	core.keysMu.Lock()
+	defer core.keysMu.Unlock()
+
 	user, err := core.DB.GetUser(core.User().ID)
 	if err != nil {
 		return err
@@ -317,30 +493,41 @@ func (core *SecureGateCore) updateAgents(ctx context.Context) error {
 	received := make(map[string]database.Machine)
 	for _, m := range core.Machines() {
 		received[m.ID] = database.Machine{
-			ID:        m.ID,
-			Name:      m.Name,
-			IP:        m.IP,
-			AgentPort: m.AgentPort,
+			ID:          m.ID,
+			Name:        m.Name,
+			IP:          m.IP,
+			AgentPort:   m.AgentPort,
+			SSHPort:     m.SSHPort,
+			Account:     m.Account,
+			AgentScheme: m.AgentScheme,
 		}
 	}
 
+	// The key is moved to the new account of a machine by unregistering
+	// it from the old one and registering it in the new one.
 	for k := range current {
-		if _, ok := received[k]; !ok {
+		if m, ok := received[k]; !ok || m.Account != current[k].Account {
 			deletions = append(deletions, backend.Machine{
-				ID:        current[k].ID,
-				Name:      current[k].Name,
-				IP:        current[k].IP,
-				AgentPort: current[k].AgentPort,
+				ID:          current[k].ID,
+				Name:        current[k].Name,
+				IP:          current[k].IP,
+				AgentPort:   current[k].AgentPort,
+				SSHPort:     current[k].SSHPort,
+				Account:     current[k].Account,
+				AgentScheme: current[k].AgentScheme,
 			})
 		}
 	}
 	for k := range received {
-		if _, ok := current[k]; !ok {
+		if m, ok := current[k]; !ok || m.Account != received[k].Account {
 			insertions = append(insertions, backend.Machine{
-				ID:        received[k].ID,
-				Name:      received[k].Name,
-				IP:        received[k].IP,
-				AgentPort: received[k].AgentPort,
+				ID:          received[k].ID,
+				Name:        received[k].Name,
+				IP:          received[k].IP,
+				AgentPort:   received[k].AgentPort,
+				SSHPort:     received[k].SSHPort,
+				Account:     received[k].Account,
+				AgentScheme: received[k].AgentScheme,
 			})
 		}
 	}
@@ -362,6 +549,9 @@ func (core *SecureGateCore) updateAgents(ctx context.Context) error {
 	// Agent running on accessible node must delete our public key from authorized_keys
 	// if the user lost rights to access the node.
 	for _, m := range deletions {
+		// Connections with the node must not outlive the rights.
+		core.pool.close(m.ID)
+
 		err := core.unregisterKeyInAgent(ctx, m)
 		if err != nil {
 			core.Logger.WithFields(logrus.Fields{
@@ -396,6 +586,15 @@ func (core *SecureGateCore) SignOut() {
 	// and stop listening to it
 	core.stopPollListening <- struct{}{}
 
+	// the key of the session must not outlive it
+	core.revokeEphemeralKey(context.Background())
+
+	// close the connections of the session
+	core.pool.closeAll()
+
+	// let the session events reach the backend
+	core.WaitSessionEvents()
+
 	// reset user informations
 	core.session = session{}
 }
@@ -405,6 +604,11 @@ func (core *SecureGateCore) User() backend.User {
 	return core.session.user.get()
 }
 
+// IsAdmin checks whether the current logged in user is an administrator.
+func (core *SecureGateCore) IsAdmin() bool {
+	return core.User().Role == RoleAdmin
+}
+
 // Machines returns the accessible nodes.
 func (core *SecureGateCore) Machines() []backend.Machine {
 	return core.session.machines.get()
@@ -448,12 +652,33 @@ func transformInDBMachines(machines []backend.Machine) []database.Machine {
 
 	for _, m := range machines {
 		dbMachines = append(dbMachines, database.Machine{
-			ID:        m.ID,
-			Name:      m.Name,
-			IP:        m.IP,
-			AgentPort: m.AgentPort,
+			ID:          m.ID,
+			Name:        m.Name,
+			IP:          m.IP,
+			AgentPort:   m.AgentPort,
+			SSHPort:     m.SSHPort,
+			Account:     m.Account,
+			AgentScheme: m.AgentScheme,
 		})
 	}
 
 	return dbMachines
 }
+
+func transformInBackendMachines(machines []database.Machine) []backend.Machine {
+	var backendMachines []backend.Machine
+
+	for _, m := range machines {
+		backendMachines = append(backendMachines, backend.Machine{
+			ID:          m.ID,
+			Name:        m.Name,
+			IP:          m.IP,
+			AgentPort:   m.AgentPort,
+			SSHPort:     m.SSHPort,
+			Account:     m.Account,
+			AgentScheme: m.AgentScheme,
+		})
+	}
+
+	return backendMachines
+}
@@ -9,13 +9,13 @@ import (
 	"net/http/httptest"
 	"os"
 	"path"
-	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/gusmin/gate/pkg/agent"
 	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/config"
 	"github.com/gusmin/gate/pkg/database"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -30,7 +30,11 @@ func (t mockTranslator) Translate(msg string) string {
 }
 
 type mockDatabaseRepository struct {
-	db map[string]database.User
+	db         map[string]database.User
+	hostKeys   map[string]database.HostKey
+	recordings map[string]database.Recording
+	rotations  map[string]database.KeyRotation
+	ephemeral  map[string]database.EphemeralKey
 }
 
 func (repo *mockDatabaseRepository) UpsertUser(user database.User) error {
@@ -47,11 +51,100 @@ func (repo *mockDatabaseRepository) GetUser(userID string) (database.User, error
 	return user, nil
 }
 
+func (repo *mockDatabaseRepository) UpsertHostKey(hostKey database.HostKey) error {
+	repo.hostKeys[hostKey.MachineID] = hostKey
+	return nil
+}
+
+func (repo *mockDatabaseRepository) GetHostKey(machineID string) (database.HostKey, error) {
+	hostKey, ok := repo.hostKeys[machineID]
+	if !ok {
+		return database.HostKey{}, database.ErrNotFound
+	}
+
+	return hostKey, nil
+}
+
+func (repo *mockDatabaseRepository) DeleteHostKey(machineID string) error {
+	delete(repo.hostKeys, machineID)
+	return nil
+}
+
+func (repo *mockDatabaseRepository) HostKeys() ([]database.HostKey, error) {
+	var hostKeys []database.HostKey
+	for _, hostKey := range repo.hostKeys {
+		hostKeys = append(hostKeys, hostKey)
+	}
+	return hostKeys, nil
+}
+
+func (repo *mockDatabaseRepository) AddRecording(recording database.Recording) error {
+	repo.recordings[recording.ID] = recording
+	return nil
+}
+
+func (repo *mockDatabaseRepository) GetRecording(id string) (database.Recording, error) {
+	recording, ok := repo.recordings[id]
+	if !ok {
+		return database.Recording{}, database.ErrNotFound
+	}
+
+	return recording, nil
+}
+
+func (repo *mockDatabaseRepository) UpsertKeyRotation(rotation database.KeyRotation) error {
+	repo.rotations[rotation.UserID] = rotation
+	return nil
+}
+
+func (repo *mockDatabaseRepository) GetKeyRotation(userID string) (database.KeyRotation, error) {
+	rotation, ok := repo.rotations[userID]
+	if !ok {
+		return database.KeyRotation{}, database.ErrNotFound
+	}
+
+	return rotation, nil
+}
+
+func (repo *mockDatabaseRepository) DeleteKeyRotation(userID string) error {
+	delete(repo.rotations, userID)
+	return nil
+}
+
+func (repo *mockDatabaseRepository) UpsertEphemeralKey(key database.EphemeralKey) error {
+	repo.ephemeral[key.Name] = key
+	return nil
+}
+
+func (repo *mockDatabaseRepository) EphemeralKeys() ([]database.EphemeralKey, error) {
+	var keys []database.EphemeralKey
+	for _, key := range repo.ephemeral {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (repo *mockDatabaseRepository) DeleteEphemeralKey(name string) error {
+	delete(repo.ephemeral, name)
+	return nil
+}
+
+func (repo *mockDatabaseRepository) Recordings(userID, machineID string) ([]database.Recording, error) {
+	var recordings []database.Recording
+	for _, recording := range repo.recordings {
+		if (userID == "" || recording.UserID == userID) &&
+			(machineID == "" || recording.MachineID == machineID) {
+			recordings = append(recordings, recording)
+		}
+	}
+	return recordings, nil
+}
+
 type mockAgentClient struct {
 	agents map[string][]byte
 }
 
-func (c *mockAgentClient) AddAuthorizedKey(ctx context.Context, endpoint, id string, key []byte) (agent.SSHAuthResponse, error) {
+func (c *mockAgentClient) AddAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (agent.SSHAuthResponse, error) {
 	if key == nil {
 		return agent.SSHAuthResponse{
 			ErrorType: "NilKey",
@@ -68,7 +161,7 @@ func (c *mockAgentClient) AddAuthorizedKey(ctx context.Context, endpoint, id str
 	return agent.SSHAuthResponse{}, nil
 }
 
-func (c *mockAgentClient) DeleteAuthorizedKey(ctx context.Context, endpoint, id string, key []byte) (agent.SSHAuthResponse, error) {
+func (c *mockAgentClient) DeleteAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (agent.SSHAuthResponse, error) {
 	if key == nil {
 		return agent.SSHAuthResponse{
 			ErrorType: "NilKey",
@@ -85,6 +178,22 @@ func (c *mockAgentClient) DeleteAuthorizedKey(ctx context.Context, endpoint, id
 	return agent.SSHAuthResponse{}, nil
 }
 
+// accountAgentClient keeps the users and remote accounts
+// authorized on each agent as "endpoint user account".
+type accountAgentClient struct {
+	authorized map[string]bool
+}
+
+func (c *accountAgentClient) AddAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (agent.SSHAuthResponse, error) {
+	c.authorized[endpoint+" "+id+" "+account] = true
+	return agent.SSHAuthResponse{}, nil
+}
+
+func (c *accountAgentClient) DeleteAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (agent.SSHAuthResponse, error) {
+	delete(c.authorized, endpoint+" "+id+" "+account)
+	return agent.SSHAuthResponse{}, nil
+}
+
 func init() {
 	logrus.SetOutput(ioutil.Discard)
 }
@@ -112,7 +221,8 @@ func TestUpdateMachines(t *testing.T) {
 						{
 							"name": "localhost",
 							"ip": "127.0.0.2",
-							"agentPort": 3002
+							"agentPort": 3002,
+							"sshPort": 2222
 						}
 					]
 				}
@@ -123,11 +233,13 @@ func TestUpdateMachines(t *testing.T) {
 					Name:      "localhost",
 					IP:        "127.0.0.1",
 					AgentPort: 3001,
+					SSHPort:   22,
 				},
 				{
 					Name:      "localhost",
 					IP:        "127.0.0.2",
 					AgentPort: 3002,
+					SSHPort:   2222,
 				},
 			},
 			err: "",
@@ -258,20 +370,24 @@ func TestUpdateUser(t *testing.T) {
 func TestInitSSHKeys(t *testing.T) {
 	assert := require.New(t)
 
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
 	tt := []struct {
 		name  string
-		path  string
+		dir   string
 		cause string
 	}{
 		{
 			name:  "valid keysDir path",
-			path:  os.TempDir(),
+			dir:   dir,
 			cause: "",
 		},
 		{
 			name:  "invalid keysDir path",
-			path:  "",
-			cause: "mkdir : no such file or directory",
+			dir:   "/dev/null",
+			cause: "mkdir /dev/null: not a directory",
 		},
 	}
 
@@ -283,28 +399,38 @@ func TestInitSSHKeys(t *testing.T) {
 		&mockTranslator{},
 		&mockDatabaseRepository{},
 	)
+	core.session.user.set(backend.User{ID: "foobar"})
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			err := core.initSSHKeys(tc.path)
+			core.Keys = NewFileKeyStore(tc.dir)
+			err := core.initSSHKeys()
 			if err != nil {
 				assert.Equalf(tc.cause, errors.Cause(err).Error(),
 					"expected error was %v, but actual is %v", tc.cause, err)
 				return
 			}
-			publicKeyPath := path.Join(tc.path, "id_rsa.pub")
-			defer os.Remove(publicKeyPath)
-			privateKeyPath := path.Join(tc.path, "id_rsa")
-			defer os.Remove(privateKeyPath)
+			assert.Equal("id_ed25519", core.session.keyName)
+
+			// check wether the keys are only accessible by their owner
+			userDir := path.Join(tc.dir, "foobar")
+			info, err := os.Stat(userDir)
+			assert.NoError(err)
+			assert.Equal(os.FileMode(0700), info.Mode().Perm())
+			for _, name := range []string{"id_ed25519", "id_ed25519.pub"} {
+				info, err := os.Stat(path.Join(userDir, name))
+				assert.NoError(err)
+				assert.Equal(os.FileMode(0600), info.Mode().Perm())
+			}
 
 			// check wether generated authorized key exists and is valid
-			authorizedKey, err := ioutil.ReadFile(publicKeyPath)
+			authorizedKey, err := ioutil.ReadFile(path.Join(userDir, "id_ed25519.pub"))
 			assert.NoError(err)
 			_, _, _, _, err = ssh.ParseAuthorizedKey(authorizedKey)
 			assert.NoError(err)
 
 			// check wether generated private key exists and is valid
-			privateKey, err := ioutil.ReadFile(privateKeyPath)
+			privateKey, err := ioutil.ReadFile(path.Join(userDir, "id_ed25519"))
 			assert.NoError(err)
 			_, err = ssh.ParsePrivateKey(privateKey)
 			assert.NoError(err)
@@ -315,25 +441,29 @@ func TestInitSSHKeys(t *testing.T) {
 func TestLoadPublicSSHKey(t *testing.T) {
 	assert := require.New(t)
 
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
 	tt := []struct {
 		name        string
-		path        string
+		init        bool
 		content     []byte
 		expectedErr string
 	}{
 		{
-			name:        "valid path",
-			path:        os.TempDir(),
+			name:        "valid key",
+			init:        true,
 			expectedErr: "",
 		},
 		{
-			name:        "invalid path",
-			path:        "",
-			expectedErr: "could not read public ssh key file: open id_rsa.pub: no such file or directory",
+			name:        "missing key",
+			init:        false,
+			expectedErr: "could not read public ssh key: key not found",
 		},
 		{
 			name:        "invalid content",
-			path:        os.TempDir(),
+			init:        true,
 			content:     []byte("owghwroghwrh"),
 			expectedErr: "could not parse authorized key: ssh: no key found",
 		},
@@ -347,18 +477,24 @@ func TestLoadPublicSSHKey(t *testing.T) {
 		&mockTranslator{},
 		&mockDatabaseRepository{},
 	)
+	core.Keys = NewFileKeyStore(dir)
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			if tc.path != "" {
-				core.initSSHKeys(tc.path)
+			core.session.user.set(backend.User{ID: tc.name})
+			core.session.keyName = "id_ed25519"
+			if tc.init {
+				assert.NoError(core.initSSHKeys())
 			}
 
 			if tc.content != nil {
-				ioutil.WriteFile(filepath.Join(tc.path, "id_rsa.pub"), tc.content, os.ModePerm)
+				pair, err := core.Keys.Get(tc.name, core.session.keyName)
+				assert.NoError(err)
+				pair.PublicKey = tc.content
+				assert.NoError(core.Keys.Put(tc.name, core.session.keyName, pair))
 			}
 
-			err := core.loadPublicSSHKey(tc.path)
+			err := core.loadPublicSSHKey(core.session.keyName)
 			if err != nil {
 				assert.Equalf(tc.expectedErr, err.Error(),
 					"expected error was: %v, but actual is: %v", tc.expectedErr, err)
@@ -407,7 +543,7 @@ func TestRegisterKeyInAgent(t *testing.T) {
 
 	agentClient := mockAgentClient{
 		agents: map[string][]byte{
-			"http://foo:3000": nil,
+			"https://foo:3000": nil,
 		},
 	}
 
@@ -431,7 +567,7 @@ func TestRegisterKeyInAgent(t *testing.T) {
 				return
 			}
 
-			key := "http://" + net.JoinHostPort(tc.machine.IP, strconv.Itoa(tc.machine.AgentPort))
+			key := "https://" + net.JoinHostPort(tc.machine.IP, strconv.Itoa(tc.machine.AgentPort))
 			assert.Equalf(tc.key, agentClient.agents[key],
 				"sent key isn't present in agent's authorized keys")
 		})
@@ -475,7 +611,7 @@ func TestUnregisterKeyInAgent(t *testing.T) {
 
 	agentClient := mockAgentClient{
 		agents: map[string][]byte{
-			"http://foo:3000": nil,
+			"https://foo:3000": nil,
 		},
 	}
 
@@ -499,7 +635,7 @@ func TestUnregisterKeyInAgent(t *testing.T) {
 				return
 			}
 
-			key := "http://" + net.JoinHostPort(tc.machine.IP, strconv.Itoa(tc.machine.AgentPort))
+			key := "https://" + net.JoinHostPort(tc.machine.IP, strconv.Itoa(tc.machine.AgentPort))
 			assert.Nil(agentClient.agents[key],
 				"sent key isn't deleted in agent")
 		})
@@ -545,7 +681,7 @@ func TestUpdateAgentsAddition(t *testing.T) {
 			},
 			agentClient: mockAgentClient{
 				agents: map[string][]byte{
-					"http://foo:3000": nil,
+					"https://foo:3000": nil,
 				},
 			},
 			expectedErr: "",
@@ -571,7 +707,7 @@ func TestUpdateAgentsAddition(t *testing.T) {
 			},
 			agentClient: mockAgentClient{
 				agents: map[string][]byte{
-					"http://foo:3000": []byte("test"),
+					"https://foo:3000": []byte("test"),
 				},
 			},
 			expectedErr: "",
@@ -607,6 +743,115 @@ func TestUpdateAgentsAddition(t *testing.T) {
 	}
 }
 
+func TestUpdateAgentsAccounts(t *testing.T) {
+	assert := require.New(t)
+
+	agentClient := &accountAgentClient{authorized: map[string]bool{}}
+	repo := &mockDatabaseRepository{
+		db: map[string]database.User{"foobar": {ID: "foobar"}},
+	}
+	core := New(
+		"gate",
+		nil,
+		agentClient,
+		logrus.StandardLogger(),
+		&mockTranslator{},
+		repo,
+	)
+	core.session.user.set(backend.User{ID: "foobar"})
+	core.session.pubKey = []byte("test")
+
+	web := backend.Machine{ID: "1", Name: "web", IP: "foo", AgentPort: 3000, Account: "deploy"}
+	db := backend.Machine{ID: "2", Name: "db", IP: "bar", AgentPort: 3000}
+
+	// Keys are registered for the account given by the backend
+	core.session.machines.set([]backend.Machine{web, db})
+	assert.NoError(core.updateAgents(context.Background()))
+	assert.Equal(map[string]bool{
+		"https://foo:3000 foobar deploy": true,
+		"https://bar:3000 foobar gate":   true,
+	}, agentClient.authorized)
+
+	// and moved when the account changes
+	db.Account = "ops"
+	core.session.machines.set([]backend.Machine{web, db})
+	assert.NoError(core.updateAgents(context.Background()))
+	assert.Equal(map[string]bool{
+		"https://foo:3000 foobar deploy": true,
+		"https://bar:3000 foobar ops":    true,
+	}, agentClient.authorized)
+
+	// Revoked access unregisters the key of the account it was given to
+	core.session.machines.set([]backend.Machine{db})
+	assert.NoError(core.updateAgents(context.Background()))
+	assert.Equal(map[string]bool{
+		"https://bar:3000 foobar ops": true,
+	}, agentClient.authorized)
+}
+
+func TestAgentEndpoint(t *testing.T) {
+	tt := []struct {
+		name        string
+		cfg         config.Configuration
+		machine     backend.Machine
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:     "https by default",
+			machine:  backend.Machine{IP: "foo", AgentPort: 3000},
+			expected: "https://foo:3000",
+		},
+		{
+			name:     "scheme of the machine",
+			cfg:      config.Configuration{AgentScheme: "http", AgentInsecure: true},
+			machine:  backend.Machine{IP: "foo", AgentPort: 3000, AgentScheme: "https"},
+			expected: "https://foo:3000",
+		},
+		{
+			name:        "plain http refused",
+			machine:     backend.Machine{IP: "foo", AgentPort: 3000, AgentScheme: "http"},
+			expectedErr: "refusing plain HTTP with the agent, agent_insecure is not set",
+		},
+		{
+			name:     "plain http allowed",
+			cfg:      config.Configuration{AgentScheme: "http", AgentInsecure: true},
+			machine:  backend.Machine{IP: "::1", AgentPort: 3000},
+			expected: "http://[::1]:3000",
+		},
+		{
+			name:        "unsupported scheme",
+			cfg:         config.Configuration{AgentScheme: "ftp"},
+			machine:     backend.Machine{IP: "foo", AgentPort: 3000},
+			expectedErr: "unsupported agent scheme ftp",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			core := New(
+				"",
+				nil,
+				&mockAgentClient{},
+				logrus.StandardLogger(),
+				&mockTranslator{},
+				&mockDatabaseRepository{},
+			)
+			core.Config = tc.cfg
+
+			endpoint, err := core.agentEndpoint(tc.machine)
+			if tc.expectedErr != "" {
+				assert.EqualError(err, tc.expectedErr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expected, endpoint)
+		})
+	}
+}
+
 func TestSignout(t *testing.T) {
 	assert := require.New(t)
 
@@ -625,7 +870,7 @@ func TestSignout(t *testing.T) {
 			select {
 			case <-core.stopPoll:
 			case <-core.stopPollListening:
-				break
+				return
 			case <-time.After(3 * time.Second):
 				assert.Fail("polling not stopped")
 			}
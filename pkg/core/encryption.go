@@ -0,0 +1,165 @@
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+)
+
+// Ways of encrypting the private keys of the users at rest.
+const (
+	// Private keys are stored in plaintext.
+	KeyEncryptionNone = "none"
+	// Private keys are encrypted with the gate master key.
+	KeyEncryptionMasterKey = "master_key"
+	// Private keys are encrypted with a key derived from the user password.
+	KeyEncryptionPassword = "password"
+)
+
+// encryptedKeyType is the PEM type of the private keys encrypted by the gate.
+const encryptedKeyType = "SECURE GATE ENCRYPTED PRIVATE KEY"
+
+// minMasterKeySize is the minimum size in bytes of the master key file.
+const minMasterKeySize = 32
+
+// keyEncryptionKey returns the key encrypting the private keys of the user,
+// or nil if they are stored in plaintext. The password is the one the user
+// signed up with.
+func (core *SecureGateCore) keyEncryptionKey(userID, password string) ([]byte, error) {
+	switch core.Config.KeyEncryption {
+	case "", KeyEncryptionNone:
+		return nil, nil
+	case KeyEncryptionMasterKey:
+		return loadMasterKey(core.Config.MasterKeyPath)
+	case KeyEncryptionPassword:
+		// The user ID salts the derivation, the same password gives
+		// different keys to different users.
+		return argon2.IDKey([]byte(password), []byte("securegate:"+userID), 1, 64*1024, 4, 32), nil
+	default:
+		return nil, fmt.Errorf("unsupported key encryption %s", core.Config.KeyEncryption)
+	}
+}
+
+// loadMasterKey reads the master key file, which must not be accessible
+// by anyone but its owner, and returns the encryption key derived from it.
+func loadMasterKey(keyPath string) ([]byte, error) {
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load master key")
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("master key %s must only be accessible by its owner", keyPath)
+	}
+
+	b, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load master key")
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) < minMasterKeySize {
+		return nil, fmt.Errorf("master key %s is too short, %d bytes at least are required", keyPath, minMasterKeySize)
+	}
+
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// encryptedPrivateKey checks whether the private key was encrypted by the gate.
+func encryptedPrivateKey(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == encryptedKeyType
+}
+
+// sealPrivateKey encrypts the PEM encoded private key with AES-256-GCM.
+func sealPrivateKey(privateKey, key []byte) ([]byte, error) {
+	aead, err := newKeyCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    encryptedKeyType,
+		Headers: map[string]string{"Nonce": hex.EncodeToString(nonce)},
+		Bytes:   aead.Seal(nil, nonce, privateKey, nil),
+	}), nil
+}
+
+// openPrivateKey decrypts the private key encrypted by sealPrivateKey.
+func openPrivateKey(data, key []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyType {
+		return nil, errors.New("not an encrypted private key")
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid nonce")
+	}
+
+	aead, err := newKeyCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	privateKey, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("wrong key encryption key")
+	}
+	return privateKey, nil
+}
+
+func newKeyCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSSHKeys encrypts the plaintext private keys of the user,
+// like the ones stored before the encryption was enabled.
+func (core *SecureGateCore) encryptSSHKeys(key []byte) error {
+	userID := core.User().ID
+	names, err := core.Keys.Keys(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		pair, err := core.Keys.Get(userID, name)
+		if err != nil {
+			return err
+		}
+		if encryptedPrivateKey(pair.PrivateKey) {
+			continue
+		}
+
+		pair.PrivateKey, err = sealPrivateKey(pair.PrivateKey, key)
+		if err != nil {
+			return err
+		}
+		if err := core.Keys.Put(userID, name, pair); err != nil {
+			return err
+		}
+		core.Logger.WithFields(logrus.Fields{
+			"user": userID,
+		}).Warnf("Encrypted SSH key %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/gusmin/gate/pkg/database"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ephemeralKeyPrefix starts the names of the ephemeral keys in the key store.
+const ephemeralKeyPrefix = "ephemeral_"
+
+// initEphemeralKey generates a key of the configured type for this session
+// only and sets it as the key of the session, the agents being given it by
+// updateAgents. The key is saved in the database until revoked, so it is
+// revoked at next start if the session never ends.
+// The persistent keys of the user are retired meanwhile.
+func (core *SecureGateCore) initEphemeralKey(ctx context.Context) error {
+	userID := core.User().ID
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	name := ephemeralKeyPrefix + hex.EncodeToString(id[:])
+
+	pair, err := generateSSHKeyPair(core.keyType(), core.session.encryptionKey)
+	if err != nil {
+		return errors.Wrap(err, "could not generate ssh key pair")
+	}
+	err = core.DB.UpsertEphemeralKey(database.EphemeralKey{
+		Name:    name,
+		UserID:  userID,
+		Key:     string(pair.PublicKey),
+		Created: pair.Created,
+	})
+	if err != nil {
+		return err
+	}
+	if err := core.Keys.Put(userID, name, pair); err != nil {
+		return errors.Wrap(err, "could not store ssh key pair")
+	}
+	core.session.keyName = name
+
+	// Keys of the user kept from previous sessions
+	return core.retireStoredKeys(ctx)
+}
+
+// ephemeralKey checks whether the key stored under the given name
+// was generated for a single session.
+func ephemeralKey(name string) bool {
+	return strings.HasPrefix(name, ephemeralKeyPrefix)
+}
+
+// revokeEphemeralKey unregisters the ephemeral key of the session from the
+// agents of every machine the user has access to and deletes it.
+// The key is revoked at next start if any agent does not confirm.
+func (core *SecureGateCore) revokeEphemeralKey(ctx context.Context) {
+	pubKey, name := core.session.key()
+	if !ephemeralKey(name) {
+		return
+	}
+
+	core.revokeKey(ctx, database.EphemeralKey{
+		Name:   name,
+		UserID: core.User().ID,
+		Key:    string(pubKey),
+	})
+}
+
+// RevokeStaleEphemeralKeys revokes the ephemeral keys left over by sessions
+// which never ended, like the ones of crashed gates, and the ones which
+// could not be revoked yet. It must be called before any session starts:
+// the database is locked by a single gate at a time, so every key found
+// belongs to a session which is over.
+func (core *SecureGateCore) RevokeStaleEphemeralKeys(ctx context.Context) error {
+	keys, err := core.DB.EphemeralKeys()
+	if err != nil {
+		return errors.Wrap(err, "could not list ephemeral keys")
+	}
+
+	for _, key := range keys {
+		core.revokeKey(ctx, key)
+	}
+	return nil
+}
+
+// revokeKey unregisters the ephemeral key from the agents of the machines
+// its user was last given access to and deletes it. It is kept in the
+// database as belonging to an ended session otherwise.
+func (core *SecureGateCore) revokeKey(ctx context.Context, key database.EphemeralKey) {
+	logFn := core.Logger.WithFields(logrus.Fields{
+		"user": key.UserID,
+	})
+
+	// The private key is useless from now on
+	if err := core.Keys.Delete(key.UserID, key.Name); err != nil {
+		logFn.Warnf("Could not delete SSH key %s: %v\n", key.Name, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+
+	user, err := core.DB.GetUser(key.UserID)
+	if err == nil {
+		err = core.deleteKeyFromAgents(ctx, key.UserID, transformInBackendMachines(user.Machines), []byte(key.Key))
+	}
+	if err != nil {
+		logFn.Warnf("Could not revoke SSH key %s: %v\n", key.Name, err)
+		if err := core.DB.UpsertEphemeralKey(key); err != nil {
+			logFn.Warnf("Could not save SSH key %s to revoke: %v\n", key.Name, err)
+		}
+		return
+	}
+
+	if err := core.DB.DeleteEphemeralKey(key.Name); err != nil {
+		logFn.Warnf("Could not forget revoked SSH key %s: %v\n", key.Name, err)
+		return
+	}
+	logFn.Warnf("Revoked SSH key %s\n", HostKeyFingerprint(key.Key))
+}
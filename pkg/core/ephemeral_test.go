@@ -0,0 +1,95 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/config"
+	"github.com/gusmin/gate/pkg/database"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEphemeralKeys(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	machines := []database.Machine{
+		{ID: "1", Name: "web", IP: "foo", AgentPort: 3000, Account: "deploy"},
+		{ID: "2", Name: "db", IP: "bar", AgentPort: 3000},
+	}
+	legacy := writeLegacyKey(t, path.Join(dir, "foobar", "id_rsa"))
+	agentClient := &keyringAgentClient{
+		keys: map[string]map[string]bool{
+			"https://foo:3000": {string(legacy): true},
+			"https://bar:3000": {string(legacy): true},
+		},
+		down: map[string]bool{},
+	}
+	repo := &mockDatabaseRepository{
+		// Machines given the key before are forgotten at login
+		db:        map[string]database.User{"foobar": {ID: "foobar"}},
+		ephemeral: map[string]database.EphemeralKey{},
+	}
+	core := New(
+		"gate",
+		nil,
+		agentClient,
+		logrus.StandardLogger(),
+		&mockTranslator{},
+		repo,
+	)
+	core.Config = config.Configuration{EphemeralKeys: true}
+	core.Keys = NewFileKeyStore(dir)
+	core.session.user.set(backend.User{ID: "foobar"})
+	core.session.machines.set(transformInBackendMachines(machines))
+
+	// A key is generated for the session and the one of previous sessions retired
+	assert.NoError(core.initEphemeralKey(context.Background()))
+	_, name := core.session.key()
+	assert.True(ephemeralKey(name))
+	names, err := core.Keys.Keys("foobar")
+	assert.NoError(err)
+	assert.Equal([]string{name}, names)
+	assert.Len(repo.ephemeral, 1)
+	assert.NoError(core.loadPublicSSHKey(name))
+	assert.NoError(core.updateAgents(context.Background()))
+	pubKey, _ := core.session.key()
+	for endpoint, keys := range agentClient.keys {
+		assert.Truef(keys[string(pubKey)], "ephemeral key not registered in %s", endpoint)
+		assert.Falsef(keys[string(legacy)], "legacy key still registered in %s", endpoint)
+	}
+
+	// and cannot be rotated
+	assert.Error(core.RotateSSHKey(context.Background()))
+
+	// The key is wiped at logout and revoked where possible
+	agentClient.down["https://bar:3000"] = true
+	core.revokeEphemeralKey(context.Background())
+	_, err = core.Keys.Get("foobar", name)
+	assert.Equal(ErrKeyNotFound, err)
+	assert.False(agentClient.keys["https://foo:3000"][string(pubKey)])
+	assert.True(agentClient.keys["https://bar:3000"][string(pubKey)])
+	assert.Contains(repo.ephemeral, name)
+
+	// then at next start, before anyone logs in, along with the keys of
+	// sessions which never ended
+	core.session = session{}
+	delete(agentClient.down, "https://bar:3000")
+	agentClient.deletedFor = map[string]bool{}
+	crashed := database.EphemeralKey{Name: ephemeralKeyPrefix + "crashed", UserID: "foobar", Key: "key"}
+	assert.NoError(repo.UpsertEphemeralKey(crashed))
+	agentClient.keys["https://foo:3000"]["key"] = true
+	assert.NoError(core.RevokeStaleEphemeralKeys(context.Background()))
+	assert.False(agentClient.keys["https://bar:3000"][string(pubKey)])
+	assert.False(agentClient.keys["https://foo:3000"]["key"])
+	assert.Empty(repo.ephemeral)
+	assert.Equal(map[string]bool{"foobar deploy": true, "foobar gate": true}, agentClient.deletedFor)
+}
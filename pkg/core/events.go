@@ -0,0 +1,56 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ReportSessionEvent sends the beginning or the end of a session to the
+// backend in the background so that a slow backend never holds the terminal
+// of the session. Events are sent in the order they are reported and
+// failures are only logged since they must not interrupt sessions.
+func (core *SecureGateCore) ReportSessionEvent(event backend.SessionEventInput) {
+	core.reportsMu.Lock()
+	previous := core.lastReport
+	done := make(chan struct{})
+	core.lastReport = done
+	core.reportsMu.Unlock()
+
+	core.reports.Add(1)
+	go func() {
+		defer core.reports.Done()
+		defer close(done)
+
+		if previous != nil {
+			<-previous
+		}
+		core.reportSessionEvent(event)
+	}()
+}
+
+// WaitSessionEvents waits for the session events being reported.
+func (core *SecureGateCore) WaitSessionEvents() {
+	core.reports.Wait()
+}
+
+func (core *SecureGateCore) reportSessionEvent(event backend.SessionEventInput) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	res, err := core.BackendClient.AddSessionEvent(ctx, event)
+	if err == nil && !res.AddSessionEvent.Success {
+		err = errors.New("the backend did not accept the event")
+	}
+	if err != nil {
+		core.Logger.WithFields(logrus.Fields{
+			"user":    event.UserID,
+			"machine": event.MachineID,
+			"account": event.Account,
+			"session": event.SessionID,
+		}).Warnf("Could not report session event %s: %v\n", event.Type, err)
+	}
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportSessionEvent(t *testing.T) {
+	assert := require.New(t)
+
+	release := make(chan struct{})
+	events := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		var body struct {
+			Variables struct {
+				SessionEvent backend.SessionEventInput `json:"sessionEvent"`
+			} `json:"variables"`
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		_ = json.Unmarshal(b, &body)
+		events <- body.Variables.SessionEvent.Type
+		rw.Write([]byte(`{"data": {"addSessionEvent": {"success": true}}}`))
+	}))
+	defer server.Close()
+
+	core := New(
+		"",
+		backend.NewClient(server.URL),
+		&mockAgentClient{},
+		logrus.StandardLogger(),
+		&mockTranslator{},
+		&mockDatabaseRepository{},
+	)
+
+	// A slow backend does not hold the session
+	reported := make(chan struct{})
+	go func() {
+		core.ReportSessionEvent(backend.SessionEventInput{Type: backend.SessionStarted})
+		core.ReportSessionEvent(backend.SessionEventInput{Type: backend.SessionEnded})
+		close(reported)
+	}()
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		assert.Fail("reporting blocked on the backend")
+	}
+
+	close(release)
+	core.WaitSessionEvents()
+
+	// Events are sent in order
+	assert.Equal(backend.SessionStarted, <-events)
+	assert.Equal(backend.SessionEnded, <-events)
+}
@@ -1,50 +1,99 @@
 package core
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
-	"io/ioutil"
-	"os"
+	"fmt"
+	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 )
 
-// exit checks wether the given path exists.
-// It returns true if path exists otherwise it returns false.
-func exist(path string) bool {
-	_, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return false
+// generateSSHKeyPair generate a pair of SSH key(public, private) of the given type.
+// The private key is encrypted with encryptionKey unless nil.
+func generateSSHKeyPair(keyType string, encryptionKey []byte) (KeyPair, error) {
+	var publicKey interface{}
+	var privateKeyPEM *pem.Block
+	switch keyType {
+	case KeyTypeEd25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		publicKey = pub
+		privateKeyPEM = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case KeyTypeRSA:
+		priv, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		publicKey = &priv.PublicKey
+		privateKeyPEM = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+	case KeyTypeECDSA:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		publicKey = &priv.PublicKey
+		privateKeyPEM = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		return KeyPair{}, fmt.Errorf("unsupported key type %s", keyType)
 	}
-	return true
-}
 
-// generateSSHKeyPair generate a pair of SSH key(public, private) in the specified paths.
-func generateSSHKeyPair(pubKeyPath, privateKeyPath string) error {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		return err
+	// encode private key as PEM, encrypted if needed
+	privateKey := pem.EncodeToMemory(privateKeyPEM)
+	if encryptionKey != nil {
+		var err error
+		privateKey, err = sealPrivateKey(privateKey, encryptionKey)
+		if err != nil {
+			return KeyPair{}, err
+		}
 	}
 
-	// generate and write private key as PEM
-	privateKeyFile, err := os.OpenFile(privateKeyPath, os.O_WRONLY|os.O_CREATE, 0600)
+	// generate public key
+	pub, err := ssh.NewPublicKey(publicKey)
 	if err != nil {
-		return err
+		return KeyPair{}, err
 	}
-	defer privateKeyFile.Close()
-	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
-	if err = pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
-		return err
+
+	return KeyPair{
+		PrivateKey: privateKey,
+		PublicKey:  ssh.MarshalAuthorizedKey(pub),
+		Created:    time.Now(),
+	}, nil
+}
+
+// parsePrivateKeySigner creates a signer from a PEM encoded private SSH key,
+// decrypted in memory with encryptionKey if encrypted.
+func parsePrivateKeySigner(privateKey, encryptionKey []byte) (ssh.Signer, error) {
+	if encryptedPrivateKey(privateKey) {
+		if encryptionKey == nil {
+			return nil, errors.New("SSH key is encrypted but no key encryption is configured")
+		}
+		var err error
+		privateKey, err = openPrivateKey(privateKey, encryptionKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decrypt SSH key")
+		}
 	}
 
-	// generate and write public key
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	key, err := ssh.ParsePrivateKey(privateKey)
 	if err != nil {
-		return err
+		return nil, errors.Wrap(err, "failed to parse private SSH key")
 	}
-	key := ssh.MarshalAuthorizedKey(pub)
-
-	return ioutil.WriteFile(pubKeyPath, key, 0655)
+	return key, nil
 }
@@ -1,9 +1,6 @@
 package core
 
 import (
-	"io/ioutil"
-	"os"
-	"path"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -11,91 +8,60 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func TestExist(t *testing.T) {
+func TestGenerateSSHKeyPair(t *testing.T) {
 	assert := require.New(t)
 
-	wd, err := os.Getwd()
-	assert.NoError(err)
-
 	tt := []struct {
-		name     string
-		path     string
-		expected bool
+		name    string
+		keyType string
+		sshType string
+		err     string
 	}{
 		{
-			name:     "existing path",
-			path:     wd,
-			expected: true,
+			name:    "ed25519",
+			keyType: KeyTypeEd25519,
+			sshType: ssh.KeyAlgoED25519,
+			err:     "",
 		},
 		{
-			name:     "not existing path",
-			path:     "pathwhichshouldnotexistactually",
-			expected: false,
+			name:    "rsa",
+			keyType: KeyTypeRSA,
+			sshType: ssh.KeyAlgoRSA,
+			err:     "",
 		},
-	}
-
-	for _, tc := range tt {
-		t.Run(tc.name, func(t *testing.T) {
-			actual := exist(tc.path)
-			assert.Equalf(tc.expected, actual,
-				"expected: %v, actual: %v\n", tc.expected, actual)
-		})
-	}
-}
-
-func TestGenerateSSHKeyPair(t *testing.T) {
-	assert := require.New(t)
-
-	tt := []struct {
-		name        string
-		pubKeyPath  string
-		privKeyPath string
-		err         string
-	}{
 		{
-			name:        "valid paths",
-			pubKeyPath:  path.Join(os.TempDir(), "id_rsa.pub"),
-			privKeyPath: path.Join(os.TempDir(), "id_rsa"),
-			err:         "",
+			name:    "ecdsa",
+			keyType: KeyTypeECDSA,
+			sshType: ssh.KeyAlgoECDSA256,
+			err:     "",
 		},
 		{
-			name:        "invalid private key path",
-			pubKeyPath:  path.Join(os.TempDir(), "id_rsa.pub"),
-			privKeyPath: "",
-			err:         "open : no such file or directory",
-		},
-		{
-			name:        "invalid public key path",
-			pubKeyPath:  "",
-			privKeyPath: path.Join(os.TempDir(), "id_rsa"),
-			err:         "open : no such file or directory",
+			name:    "unsupported key type",
+			keyType: "dsa",
+			err:     "unsupported key type dsa",
 		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			err := generateSSHKeyPair(tc.pubKeyPath, tc.privKeyPath)
+			pair, err := generateSSHKeyPair(tc.keyType, nil)
 			if err != nil {
 				assert.Equalf(tc.err, errors.Cause(err).Error(),
 					"expected error was %v, but got %v", tc.err, err)
 				return
 			}
-			defer func() {
-				os.Remove(tc.pubKeyPath)
-				os.Remove(tc.privKeyPath)
-			}()
+			assert.False(pair.Created.IsZero())
 
-			// check wether generated authorized key exists and is valid
-			b, err := ioutil.ReadFile(tc.pubKeyPath)
-			assert.NoError(err)
-			_, _, _, _, err = ssh.ParseAuthorizedKey(b)
+			// check wether generated authorized key is valid
+			pub, _, _, _, err := ssh.ParseAuthorizedKey(pair.PublicKey)
 			assert.NoError(err)
+			assert.Equal(tc.sshType, pub.Type())
+			assert.True(upToDate(pub, tc.keyType))
 
-			// check wether generated private key exists and is valid
-			privateKey, err := ioutil.ReadFile(tc.privKeyPath)
-			assert.NoError(err)
-			_, err = ssh.ParsePrivateKey(privateKey)
+			// check wether generated private key is valid and matches
+			signer, err := ssh.ParsePrivateKey(pair.PrivateKey)
 			assert.NoError(err)
+			assert.Equal(pub.Marshal(), signer.PublicKey().Marshal())
 		})
 	}
 }
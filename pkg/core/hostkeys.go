@@ -0,0 +1,189 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/database"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Origins of a pinned host key.
+const (
+	hostKeySourceTOFU     = "tofu"     // pinned on first use
+	hostKeySourceBackend  = "backend"  // pushed by the backend
+	hostKeySourceApproved = "approved" // approved after a change
+)
+
+// RoleAdmin is the role of the users administrating the gate.
+const RoleAdmin = "admin"
+
+// ErrNotAdmin is returned when a user who is not an administrator
+// tries to change the trusted host keys.
+var ErrNotAdmin = errors.New("only administrators can change trusted host keys")
+
+// HostKeyMismatchError is returned when a machine presents a host key
+// different from the one which is trusted for it.
+type HostKeyMismatchError struct {
+	Machine  string // name of the machine
+	Expected string // fingerprint of the trusted key
+	Actual   string // fingerprint of the presented key
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key of %s changed: expected %s, got %s", e.Machine, e.Expected, e.Actual)
+}
+
+// HostKeyCallback returns a callback verifying the host key presented by the
+// given machine during the SSH handshake.
+// Keys pushed by the backend are trusted first. Otherwise the key presented
+// on first use is pinned in the database and every later key must match it.
+func (core *SecureGateCore) HostKeyCallback(machine backend.Machine) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return core.verifyHostKey(machine, key)
+	}
+}
+
+// verifyHostKey checks the key presented by the machine against the trusted ones.
+func (core *SecureGateCore) verifyHostKey(machine backend.Machine, key ssh.PublicKey) error {
+	presented := marshalHostKey(key)
+	logger := core.Logger.WithFields(logrus.Fields{
+		"user":    core.User().ID,
+		"machine": machine.ID,
+		"account": core.Account(machine),
+	})
+
+	pinned, err := core.DB.GetHostKey(machine.ID)
+	if err != nil && err != database.ErrNotFound {
+		return errors.Wrap(err, "could not retrieve pinned host key")
+	}
+	exists := err == nil
+
+	// Keys known by the backend take precedence over keys pinned on first use.
+	if len(machine.HostKeys) > 0 {
+		var expected []string
+		for _, k := range machine.HostKeys {
+			known, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+			if err != nil {
+				continue
+			}
+			if marshalHostKey(known) == presented {
+				if exists && pinned.Key == presented {
+					return nil
+				}
+				return core.pinHostKey(machine.ID, presented, hostKeySourceBackend)
+			}
+			expected = append(expected, ssh.FingerprintSHA256(known))
+		}
+		return core.refuseHostKey(logger, machine, strings.Join(expected, ", "), key)
+	}
+
+	if !exists {
+		// Trust on first use.
+		err := core.pinHostKey(machine.ID, presented, hostKeySourceTOFU)
+		if err != nil {
+			return err
+		}
+		logger.Warnf(core.Translator.Translate("HostKeyPinned"), machine.Name, ssh.FingerprintSHA256(key))
+		return nil
+	}
+
+	if pinned.Key == presented {
+		return nil
+	}
+
+	// Keep the presented key aside so an administrator can approve it.
+	pinned.Pending = presented
+	err = core.DB.UpsertHostKey(pinned)
+	if err != nil {
+		return errors.Wrap(err, "could not store pending host key")
+	}
+	return core.refuseHostKey(logger, machine, HostKeyFingerprint(pinned.Key), key)
+}
+
+// refuseHostKey loudly warns the user about a changed host key and returns
+// the corresponding error.
+func (core *SecureGateCore) refuseHostKey(logger *logrus.Entry, machine backend.Machine, expected string, key ssh.PublicKey) error {
+	actual := ssh.FingerprintSHA256(key)
+	logger.Errorf(core.Translator.Translate("HostKeyChanged"), machine.Name, expected, actual, machine.Name)
+	return &HostKeyMismatchError{
+		Machine:  machine.Name,
+		Expected: expected,
+		Actual:   actual,
+	}
+}
+
+// pinHostKey stores the key as the trusted host key of the machine.
+func (core *SecureGateCore) pinHostKey(machineID, key, source string) error {
+	err := core.DB.UpsertHostKey(database.HostKey{
+		MachineID: machineID,
+		Key:       key,
+		Source:    source,
+		FirstSeen: time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not pin host key")
+	}
+	return nil
+}
+
+// HostKeys returns every pinned host key.
+func (core *SecureGateCore) HostKeys() ([]database.HostKey, error) {
+	return core.DB.HostKeys()
+}
+
+// ApproveHostKey replaces the host key pinned for the machine by the
+// one it presented during the last refused connection.
+// Only administrators can approve host keys.
+func (core *SecureGateCore) ApproveHostKey(machineID string) error {
+	if !core.IsAdmin() {
+		return ErrNotAdmin
+	}
+	hostKey, err := core.DB.GetHostKey(machineID)
+	if err != nil {
+		return errors.Wrapf(err, "could not retrieve host key of %s", machineID)
+	}
+	if hostKey.Pending == "" {
+		return fmt.Errorf("no pending host key for %s", machineID)
+	}
+
+	return core.pinHostKey(machineID, hostKey.Pending, hostKeySourceApproved)
+}
+
+// ForgetHostKey removes the host key pinned for the machine.
+// The next presented key will be pinned on first use again.
+// Only administrators can forget host keys.
+func (core *SecureGateCore) ForgetHostKey(machineID string) error {
+	if !core.IsAdmin() {
+		return ErrNotAdmin
+	}
+	_, err := core.DB.GetHostKey(machineID)
+	if err != nil {
+		return errors.Wrapf(err, "could not retrieve host key of %s", machineID)
+	}
+
+	return core.DB.DeleteHostKey(machineID)
+}
+
+// marshalHostKey serializes the key in authorized_keys format without trailing new line.
+func marshalHostKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// HostKeyFingerprint returns the SHA256 fingerprint of a key in authorized_keys
+// format or an empty string if the key can not be parsed.
+func HostKeyFingerprint(authorizedKey string) string {
+	if authorizedKey == "" {
+		return ""
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/database"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// newHostKey generates a random host public key.
+func newHostKey(assert *require.Assertions) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.NoError(err)
+	return key
+}
+
+func TestVerifyHostKey(t *testing.T) {
+	assert := require.New(t)
+
+	known := newHostKey(assert)
+	other := newHostKey(assert)
+
+	tt := []struct {
+		name            string
+		machine         backend.Machine
+		pinned          map[string]database.HostKey
+		presented       ssh.PublicKey
+		expectedErr     string
+		expectedKey     string
+		expectedPending string
+	}{
+		{
+			name:        "trust on first use",
+			machine:     backend.Machine{ID: "foo", Name: "foo"},
+			pinned:      map[string]database.HostKey{},
+			presented:   known,
+			expectedKey: marshalHostKey(known),
+		},
+		{
+			name:    "pinned key matches",
+			machine: backend.Machine{ID: "foo", Name: "foo"},
+			pinned: map[string]database.HostKey{
+				"foo": {MachineID: "foo", Key: marshalHostKey(known)},
+			},
+			presented:   known,
+			expectedKey: marshalHostKey(known),
+		},
+		{
+			name:    "pinned key changed",
+			machine: backend.Machine{ID: "foo", Name: "foo"},
+			pinned: map[string]database.HostKey{
+				"foo": {MachineID: "foo", Key: marshalHostKey(known)},
+			},
+			presented: other,
+			expectedErr: "host key of foo changed: expected " +
+				ssh.FingerprintSHA256(known) + ", got " + ssh.FingerprintSHA256(other),
+			expectedKey:     marshalHostKey(known),
+			expectedPending: marshalHostKey(other),
+		},
+		{
+			name: "key pushed by the backend",
+			machine: backend.Machine{
+				ID:       "foo",
+				Name:     "foo",
+				HostKeys: []string{string(ssh.MarshalAuthorizedKey(other))},
+			},
+			pinned: map[string]database.HostKey{
+				"foo": {MachineID: "foo", Key: marshalHostKey(known)},
+			},
+			presented:   other,
+			expectedKey: marshalHostKey(other),
+		},
+		{
+			name: "key not pushed by the backend",
+			machine: backend.Machine{
+				ID:       "foo",
+				Name:     "foo",
+				HostKeys: []string{string(ssh.MarshalAuthorizedKey(known))},
+			},
+			pinned:    map[string]database.HostKey{},
+			presented: other,
+			expectedErr: "host key of foo changed: expected " +
+				ssh.FingerprintSHA256(known) + ", got " + ssh.FingerprintSHA256(other),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := &mockDatabaseRepository{hostKeys: tc.pinned}
+			core := New(
+				"",
+				nil,
+				nil,
+				logrus.StandardLogger(),
+				&mockTranslator{},
+				repo,
+			)
+
+			err := core.HostKeyCallback(tc.machine)("", nil, tc.presented)
+			if tc.expectedErr != "" {
+				assert.EqualError(err, tc.expectedErr)
+			} else {
+				assert.NoError(err)
+			}
+
+			hostKey := repo.hostKeys[tc.machine.ID]
+			assert.Equal(tc.expectedKey, hostKey.Key)
+			assert.Equal(tc.expectedPending, hostKey.Pending)
+		})
+	}
+}
+
+func TestApproveHostKey(t *testing.T) {
+	assert := require.New(t)
+
+	known := marshalHostKey(newHostKey(assert))
+	other := marshalHostKey(newHostKey(assert))
+
+	repo := &mockDatabaseRepository{
+		hostKeys: map[string]database.HostKey{
+			"foo": {MachineID: "foo", Key: known},
+			"bar": {MachineID: "bar", Key: known, Pending: other},
+		},
+	}
+	core := New(
+		"",
+		nil,
+		nil,
+		logrus.StandardLogger(),
+		&mockTranslator{},
+		repo,
+	)
+
+	// Users cannot change the trusted keys
+	core.session.user.set(backend.User{ID: "foobar"})
+	assert.Equal(ErrNotAdmin, core.ApproveHostKey("bar"))
+	assert.Equal(ErrNotAdmin, core.ForgetHostKey("bar"))
+	assert.Equal(known, repo.hostKeys["bar"].Key)
+
+	core.session.user.set(backend.User{ID: "admin", Role: RoleAdmin})
+	assert.EqualError(core.ApproveHostKey("foo"), "no pending host key for foo")
+	assert.EqualError(core.ApproveHostKey("baz"), "could not retrieve host key of baz: not found")
+
+	assert.NoError(core.ApproveHostKey("bar"))
+	assert.Equal(other, repo.hostKeys["bar"].Key)
+	assert.Empty(repo.hostKeys["bar"].Pending)
+
+	assert.NoError(core.ForgetHostKey("bar"))
+	assert.NotContains(repo.hostKeys, "bar")
+}
@@ -0,0 +1,304 @@
+package core
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Types of the SSH keys generated for users.
+const (
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+)
+
+// rsaKeyBits is the size of the generated RSA keys,
+// smaller RSA keys are migrated.
+const rsaKeyBits = 4096
+
+// keyNames are the names of the key pairs which may be stored for a user.
+var keyNames = []string{
+	"id_ed25519", "id_ecdsa", "id_rsa",
+	"id_ed25519.old", "id_ecdsa.old", "id_rsa.old",
+}
+
+// keyFileName returns the name of the private key of the given type.
+func keyFileName(keyType string) (string, error) {
+	switch keyType {
+	case KeyTypeEd25519, KeyTypeRSA, KeyTypeECDSA:
+		return "id_" + keyType, nil
+	default:
+		return "", fmt.Errorf("unsupported key type %s", keyType)
+	}
+}
+
+// keyType returns the configured type of the user SSH keys, Ed25519 by default.
+func (core *SecureGateCore) keyType() string {
+	if core.Config.KeyType == "" {
+		return KeyTypeEd25519
+	}
+	return core.Config.KeyType
+}
+
+// upToDate checks whether the public key is of the given type
+// and, for RSA keys, long enough.
+func upToDate(key ssh.PublicKey, keyType string) bool {
+	switch keyType {
+	case KeyTypeEd25519:
+		return key.Type() == ssh.KeyAlgoED25519
+	case KeyTypeECDSA:
+		return strings.HasPrefix(key.Type(), "ecdsa-sha2-")
+	case KeyTypeRSA:
+		if key.Type() != ssh.KeyAlgoRSA {
+			return false
+		}
+		cryptoKey, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return false
+		}
+		rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+		return ok && rsaKey.N.BitLen() >= rsaKeyBits
+	default:
+		return false
+	}
+}
+
+// storedKeys returns the names of the key pairs stored for the user.
+func (core *SecureGateCore) storedKeys() (map[string]bool, error) {
+	names, err := core.Keys.Keys(core.User().ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list ssh keys")
+	}
+	stored := make(map[string]bool)
+	for _, name := range names {
+		stored[name] = true
+	}
+	return stored, nil
+}
+
+// publicKey returns the public key of the key pair of the user
+// stored under the given name.
+func (core *SecureGateCore) publicKey(name string) ([]byte, ssh.PublicKey, error) {
+	pair, err := core.Keys.Get(core.User().ID, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(pair.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pair.PublicKey, key, nil
+}
+
+// keySigner returns a signer of the key pair of the user stored under
+// the given name, the private key being decrypted in memory only.
+func (core *SecureGateCore) keySigner(name string) (ssh.Signer, error) {
+	pair, err := core.Keys.Get(core.User().ID, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read SSH key %s", name)
+	}
+	return parsePrivateKeySigner(pair.PrivateKey, core.session.encryptionKey)
+}
+
+// signer returns a signer of the key of the session,
+// which is the public key registered in the agents.
+func (core *SecureGateCore) signer() (ssh.Signer, error) {
+	pubKey, name := core.session.key()
+	if core.externalKey() {
+		return newAgentSigner(core.session.keySocket, pubKey)
+	}
+	return core.keySigner(name)
+}
+
+// migrateSSHKeys makes sure the user uses a key of the configured type
+// and sets it as the key of the session.
+//
+// When the key of the user is outdated, like the 1024 bits RSA keys of
+// previous versions, a new key is generated and registered with the agents
+// of every machine the user had access to. The new key is used only once
+// every agent confirmed, then the outdated key is unregistered and deleted.
+// Otherwise the outdated key is kept and the migration resumes at next login.
+func (core *SecureGateCore) migrateSSHKeys(ctx context.Context) error {
+	name, err := keyFileName(core.keyType())
+	if err != nil {
+		return err
+	}
+	userID := core.User().ID
+	logFn := core.Logger.WithFields(logrus.Fields{
+		"user": userID,
+	})
+	stored, err := core.storedKeys()
+	if err != nil {
+		return err
+	}
+
+	// An outdated key with the name of the new one is moved aside first.
+	if stored[name] {
+		if _, key, err := core.publicKey(name); err != nil || !upToDate(key, core.keyType()) {
+			if err := core.Keys.Rename(userID, name, name+".old"); err != nil {
+				return errors.Wrap(err, "could not move outdated ssh key")
+			}
+			delete(stored, name)
+			stored[name+".old"] = true
+		}
+	}
+
+	var outdated []string
+	for _, n := range keyNames {
+		if n != name && stored[n] {
+			outdated = append(outdated, n)
+		}
+	}
+
+	if !stored[name] {
+		if len(outdated) == 0 {
+			return core.initSSHKeys()
+		}
+
+		// Reuse the key of an interrupted migration.
+		pending := name + ".new"
+		if !stored[pending] {
+			pair, err := generateSSHKeyPair(core.keyType(), core.session.encryptionKey)
+			if err != nil {
+				return errors.Wrap(err, "could not generate ssh key pair")
+			}
+			if err := core.Keys.Put(userID, pending, pair); err != nil {
+				return errors.Wrap(err, "could not store ssh key pair")
+			}
+		}
+		pub, _, err := core.publicKey(pending)
+		if err != nil {
+			return errors.Wrap(err, "could not read new public ssh key")
+		}
+
+		machines, err := core.keyMachines()
+		if err != nil {
+			return err
+		}
+		if err := core.sendKeyToAgents(ctx, machines, pub); err != nil {
+			logFn.Warnf("Could not migrate SSH key %s: %v\n", outdated[0], err)
+			core.session.keyName = outdated[0]
+			return nil
+		}
+		if err := core.Keys.Rename(userID, pending, name); err != nil {
+			return errors.Wrap(err, "could not move new ssh key")
+		}
+		logFn.Warnf("Migrated SSH key %s to %s\n", outdated[0], name)
+	}
+	core.session.keyName = name
+
+	for _, old := range outdated {
+		core.retireSSHKey(ctx, old)
+	}
+	return nil
+}
+
+// retireStoredKeys retires the keys of the user kept in the key store,
+// when sessions use keys of another kind.
+func (core *SecureGateCore) retireStoredKeys(ctx context.Context) error {
+	stored, err := core.storedKeys()
+	if err != nil {
+		return err
+	}
+	for _, n := range keyNames {
+		for _, name := range []string{n, n + ".new"} {
+			if stored[name] {
+				core.retireSSHKey(ctx, name)
+			}
+		}
+	}
+	return nil
+}
+
+// retireSSHKey unregisters the key stored under the given name from the
+// agents of every machine the user had access to and deletes it once all of
+// them confirmed. The key is kept to try again at next login otherwise.
+func (core *SecureGateCore) retireSSHKey(ctx context.Context, name string) {
+	logFn := core.Logger.WithFields(logrus.Fields{
+		"user": core.User().ID,
+	})
+
+	pub, _, err := core.publicKey(name)
+	if err == nil {
+		var machines []backend.Machine
+		machines, err = core.keyMachines()
+		if err == nil {
+			err = core.deleteKeyFromAgents(ctx, core.User().ID, machines, pub)
+		}
+	}
+	if err != nil {
+		logFn.Warnf("Could not unregister SSH key %s: %v\n", name, err)
+		return
+	}
+
+	if err := core.Keys.Delete(core.User().ID, name); err != nil {
+		logFn.Warnf("Could not delete SSH key %s: %v\n", name, err)
+	}
+}
+
+// registeredMachines returns the machines the agents of which
+// were last given the key of the user.
+func (core *SecureGateCore) registeredMachines() ([]backend.Machine, error) {
+	user, err := core.DB.GetUser(core.User().ID)
+	if err != nil {
+		return nil, err
+	}
+	return transformInBackendMachines(user.Machines), nil
+}
+
+// keyMachines returns the machines the agents of which may know the keys
+// of the user: the ones last given his key and the accessible ones, the
+// former being forgotten at login.
+func (core *SecureGateCore) keyMachines() ([]backend.Machine, error) {
+	machines, err := core.registeredMachines()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, m := range machines {
+		known[m.ID] = true
+	}
+	for _, m := range core.Machines() {
+		if !known[m.ID] {
+			machines = append(machines, m)
+		}
+	}
+	return machines, nil
+}
+
+// sendKeyToAgents registers the key in the agents of the machines.
+// It fails if any of them does not confirm.
+func (core *SecureGateCore) sendKeyToAgents(ctx context.Context, machines []backend.Machine, key []byte) error {
+	var failed []string
+	for _, m := range machines {
+		if err := core.sendKeyToAgent(ctx, m, key); err != nil {
+			failed = append(failed, m.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("not confirmed by %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// deleteKeyFromAgents unregisters the key of the user from the agents of
+// the machines. It fails if any of them does not confirm.
+func (core *SecureGateCore) deleteKeyFromAgents(ctx context.Context, userID string, machines []backend.Machine, key []byte) error {
+	var failed []string
+	for _, m := range machines {
+		if err := core.deleteKeyFromAgent(ctx, userID, m, key); err != nil {
+			failed = append(failed, m.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("not confirmed by %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gusmin/gate/pkg/agent"
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/config"
+	"github.com/gusmin/gate/pkg/database"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyringAgentClient keeps the authorized keys of each agent,
+// the agents marked as down failing every request.
+type keyringAgentClient struct {
+	keys map[string]map[string]bool
+	down map[string]bool
+	// users and accounts keys were deleted for as "user account", if not nil
+	deletedFor map[string]bool
+}
+
+func (c *keyringAgentClient) AddAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (agent.SSHAuthResponse, error) {
+	if c.down[endpoint] {
+		return agent.SSHAuthResponse{}, fmt.Errorf("no agent running")
+	}
+	if c.keys[endpoint] == nil {
+		c.keys[endpoint] = make(map[string]bool)
+	}
+	c.keys[endpoint][string(key)] = true
+	return agent.SSHAuthResponse{}, nil
+}
+
+func (c *keyringAgentClient) DeleteAuthorizedKey(ctx context.Context, endpoint, id, account string, key []byte) (agent.SSHAuthResponse, error) {
+	if c.down[endpoint] {
+		return agent.SSHAuthResponse{}, fmt.Errorf("no agent running")
+	}
+	delete(c.keys[endpoint], string(key))
+	if c.deletedFor != nil {
+		c.deletedFor[id+" "+account] = true
+	}
+	return agent.SSHAuthResponse{}, nil
+}
+
+// writeLegacyKey writes a 1024 bits RSA key pair like previous versions did,
+// with loose permissions.
+func writeLegacyKey(t *testing.T, keyPath string) []byte {
+	require.NoError(t, os.MkdirAll(path.Dir(keyPath), os.ModePerm))
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	require.NoError(t, ioutil.WriteFile(keyPath, b, 0600))
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	authorizedKey := ssh.MarshalAuthorizedKey(pub)
+	require.NoError(t, ioutil.WriteFile(keyPath+".pub", authorizedKey, 0655))
+	return authorizedKey
+}
+
+func TestMigrateSSHKeys(t *testing.T) {
+	assert := require.New(t)
+
+	machines := []database.Machine{
+		{ID: "1", Name: "web", IP: "foo", AgentPort: 3000},
+		{ID: "2", Name: "db", IP: "bar", AgentPort: 3000},
+	}
+
+	tt := []struct {
+		name    string
+		keyType string
+		down    map[string]bool
+		// key type in use after the migration, the legacy one if empty
+		expected string
+	}{
+		{
+			name:     "ed25519",
+			keyType:  "",
+			expected: ssh.KeyAlgoED25519,
+		},
+		{
+			name:     "rsa",
+			keyType:  KeyTypeRSA,
+			expected: ssh.KeyAlgoRSA,
+		},
+		{
+			name:     "ecdsa",
+			keyType:  KeyTypeECDSA,
+			expected: ssh.KeyAlgoECDSA256,
+		},
+		{
+			name:    "agent down",
+			keyType: KeyTypeEd25519,
+			down:    map[string]bool{"https://bar:3000": true},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "keys")
+			assert.NoError(err)
+			defer os.RemoveAll(dir)
+
+			legacy := writeLegacyKey(t, path.Join(dir, "foobar", "id_rsa"))
+			agentClient := &keyringAgentClient{
+				keys: map[string]map[string]bool{
+					"https://foo:3000": {string(legacy): true},
+					"https://bar:3000": {string(legacy): true},
+				},
+				down: tc.down,
+			}
+			core := New(
+				"",
+				nil,
+				agentClient,
+				logrus.StandardLogger(),
+				&mockTranslator{},
+				&mockDatabaseRepository{
+					db: map[string]database.User{
+						"foobar": {ID: "foobar", Machines: machines[:1]},
+					},
+				},
+			)
+			core.Config = config.Configuration{KeyType: tc.keyType}
+			core.Keys = NewFileKeyStore(dir)
+			core.session.user.set(backend.User{ID: "foobar"})
+			// Machines given the key before are forgotten at login
+			core.session.machines.set(transformInBackendMachines(machines[1:]))
+
+			assert.NoError(core.migrateSSHKeys(context.Background()))
+
+			if tc.expected == "" {
+				// Nothing changes until every agent confirms
+				assert.Equal("id_rsa", core.session.keyName)
+				assert.True(agentClient.keys["https://foo:3000"][string(legacy)])
+
+				// and the migration resumes at next login with the same key
+				pending, _, err := core.publicKey("id_" + tc.keyType + ".new")
+				assert.NoError(err)
+				delete(agentClient.down, "https://bar:3000")
+				assert.NoError(core.migrateSSHKeys(context.Background()))
+				assert.Equal("id_"+tc.keyType, core.session.keyName)
+				assert.True(agentClient.keys["https://bar:3000"][string(pending)])
+				assert.False(agentClient.keys["https://bar:3000"][string(legacy)])
+				return
+			}
+
+			pub, key, err := core.publicKey(core.session.keyName)
+			assert.NoError(err)
+			assert.Equal(tc.expected, key.Type())
+			_, err = core.signer()
+			assert.NoError(err)
+			for endpoint, keys := range agentClient.keys {
+				assert.Truef(keys[string(pub)], "new key not registered in %s", endpoint)
+				assert.Falsef(keys[string(legacy)], "legacy key still registered in %s", endpoint)
+			}
+
+			// The legacy key is gone and nothing else remains
+			files, err := ioutil.ReadDir(path.Join(dir, "foobar"))
+			assert.NoError(err)
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name())
+				assert.Equal(os.FileMode(0600), f.Mode().Perm())
+			}
+			name := core.session.keyName
+			assert.ElementsMatch([]string{name, name + ".pub"}, names)
+		})
+	}
+}
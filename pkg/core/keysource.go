@@ -0,0 +1,121 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Sources of the SSH keys users log into machines with.
+const (
+	// Keys generated by the gate and kept in its key store
+	KeySourceStore = "store"
+	// Keys offered by the ssh-agent of SSH_AUTH_SOCK, like one forwarded by the user
+	KeySourceSSHAgent = "ssh_agent"
+	// Keys offered by an external signing helper speaking the ssh-agent protocol
+	KeySourceSigner = "signer"
+)
+
+// keySource returns the configured source of the user SSH keys,
+// the key store by default.
+func (core *SecureGateCore) keySource() string {
+	if core.Config.KeySource == "" {
+		return KeySourceStore
+	}
+	return core.Config.KeySource
+}
+
+// keySocket returns the socket of the agent offering the keys
+// of the configured source.
+func (core *SecureGateCore) keySocket() (string, error) {
+	switch core.keySource() {
+	case KeySourceSSHAgent:
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return "", errors.New("SSH_AUTH_SOCK is not set, no ssh-agent to get keys from")
+		}
+		return socket, nil
+	case KeySourceSigner:
+		if core.Config.SignerSocket == "" {
+			return "", errors.New("no signer socket configured")
+		}
+		return core.Config.SignerSocket, nil
+	default:
+		return "", fmt.Errorf("unsupported key source %s", core.keySource())
+	}
+}
+
+// initExternalKey sets the key offered by the agent of the configured source
+// as the key of the session, the one of the configured fingerprint or the
+// first one. The private key never reaches the gate, every signature being
+// requested from the agent.
+func (core *SecureGateCore) initExternalKey() error {
+	socket, err := core.keySocket()
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return errors.Wrap(err, "could not reach the agent offering ssh keys")
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return errors.Wrap(err, "could not list the keys of the agent")
+	}
+	for _, key := range keys {
+		if core.Config.KeyFingerprint != "" && ssh.FingerprintSHA256(key) != core.Config.KeyFingerprint {
+			continue
+		}
+		core.session.keySocket = socket
+		core.session.keyName = ""
+		core.session.pubKey = ssh.MarshalAuthorizedKey(key)
+		return nil
+	}
+	if core.Config.KeyFingerprint != "" {
+		return fmt.Errorf("the agent does not offer the key %s", core.Config.KeyFingerprint)
+	}
+	return errors.New("the agent does not offer any key")
+}
+
+// externalKey checks whether the key of the session is offered by an agent.
+func (core *SecureGateCore) externalKey() bool {
+	return core.session.keySocket != ""
+}
+
+// agentSigner signs with a key offered by the agent listening on socket,
+// connecting to it for each signature.
+type agentSigner struct {
+	socket string
+	key    ssh.PublicKey
+}
+
+// newAgentSigner returns a signer of the public key, in authorized_keys
+// format, offered by the agent listening on socket.
+func newAgentSigner(socket string, authorizedKey []byte) (ssh.Signer, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse authorized key")
+	}
+	return &agentSigner{socket: socket, key: key}, nil
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not reach the agent offering ssh keys")
+	}
+	defer conn.Close()
+
+	return agent.NewClient(conn).Sign(s.key, data)
+}
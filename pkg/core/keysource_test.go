@@ -0,0 +1,142 @@
+package core
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent serves an agent holding two keys on a socket in dir.
+func serveAgent(t *testing.T, dir string) (string, []ssh.PublicKey) {
+	keyring := agent.NewKeyring()
+	var keys []ssh.PublicKey
+	for i := 0; i < 2; i++ {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: priv}))
+		signer, err := ssh.NewSignerFromKey(priv)
+		require.NoError(t, err)
+		keys = append(keys, signer.PublicKey())
+	}
+
+	socket := path.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return socket, keys
+}
+
+func TestExternalKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket, keys := serveAgent(t, dir)
+
+	tt := []struct {
+		name        string
+		cfg         config.Configuration
+		authSock    string
+		expected    ssh.PublicKey
+		expectedErr string
+	}{
+		{
+			name:     "ssh-agent",
+			cfg:      config.Configuration{KeySource: KeySourceSSHAgent},
+			authSock: socket,
+			expected: keys[0],
+		},
+		{
+			name:        "no ssh-agent",
+			cfg:         config.Configuration{KeySource: KeySourceSSHAgent},
+			expectedErr: "SSH_AUTH_SOCK is not set, no ssh-agent to get keys from",
+		},
+		{
+			name: "signer",
+			cfg: config.Configuration{
+				KeySource:      KeySourceSigner,
+				SignerSocket:   socket,
+				KeyFingerprint: ssh.FingerprintSHA256(keys[1]),
+			},
+			expected: keys[1],
+		},
+		{
+			name: "unknown key",
+			cfg: config.Configuration{
+				KeySource:      KeySourceSigner,
+				SignerSocket:   socket,
+				KeyFingerprint: "SHA256:foobar",
+			},
+			expectedErr: "the agent does not offer the key SHA256:foobar",
+		},
+		{
+			name:        "unsupported source",
+			cfg:         config.Configuration{KeySource: "vault"},
+			expectedErr: "unsupported key source vault",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			oldAuthSock := os.Getenv("SSH_AUTH_SOCK")
+			os.Setenv("SSH_AUTH_SOCK", tc.authSock)
+			defer os.Setenv("SSH_AUTH_SOCK", oldAuthSock)
+
+			core := New(
+				"",
+				nil,
+				nil,
+				logrus.StandardLogger(),
+				&mockTranslator{},
+				&mockDatabaseRepository{},
+			)
+			core.Config = tc.cfg
+			core.session.user.set(backend.User{ID: "foobar"})
+
+			err := core.initExternalKey()
+			if tc.expectedErr != "" {
+				assert.EqualError(err, tc.expectedErr)
+				return
+			}
+			assert.NoError(err)
+
+			// The registered key is the one signing
+			pubKey, _ := core.session.key()
+			assert.Equal(string(ssh.MarshalAuthorizedKey(tc.expected)), string(pubKey))
+			signer, err := core.signer()
+			assert.NoError(err)
+			assert.Equal(tc.expected.Marshal(), signer.PublicKey().Marshal())
+			signature, err := signer.Sign(rand.Reader, []byte("data"))
+			assert.NoError(err)
+			assert.NoError(tc.expected.Verify([]byte("data"), signature))
+
+			// and is not rotated
+			assert.Error(core.RotateSSHKey(context.Background()))
+			assert.NoError(core.rotateSSHKeyIfNeeded(context.Background()))
+		})
+	}
+}
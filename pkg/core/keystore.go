@@ -0,0 +1,344 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Kinds of key stores.
+const (
+	KeyStoreFile = "file"
+	KeyStoreBolt = "bolt"
+)
+
+// ErrKeyNotFound is returned when the requested key pair is not stored.
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyPair is an SSH key pair of a user.
+type KeyPair struct {
+	// PEM encoded private key, encrypted by the gate or not
+	PrivateKey []byte `json:"privateKey"`
+	// Public key in authorized_keys format
+	PublicKey []byte `json:"publicKey"`
+	// When the pair was generated, set when stored if zero
+	Created time.Time `json:"created"`
+}
+
+// KeyStore stores the SSH key pairs of the users, each one under a name
+// like "id_ed25519".
+type KeyStore interface {
+	// Keys returns the names of the key pairs of the user.
+	Keys(userID string) ([]string, error)
+	// Get returns the key pair of the user stored under the given name,
+	// or ErrKeyNotFound.
+	Get(userID, name string) (KeyPair, error)
+	// Put stores the key pair of the user under the given name,
+	// replacing the pair stored under this name if any.
+	Put(userID, name string, pair KeyPair) error
+	// Rename moves the key pair of the user stored under from to to.
+	Rename(userID, from, to string) error
+	// Delete removes the key pair of the user stored under the given name.
+	// Deleting a missing pair is not an error.
+	Delete(userID, name string) error
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// OpenKeyStore opens the key store of the given kind at location,
+// the default location of the kind if empty.
+func OpenKeyStore(kind, location string) (KeyStore, error) {
+	switch kind {
+	case "", KeyStoreFile:
+		if location == "" {
+			location = secureGateKeysDir
+		}
+		return NewFileKeyStore(location), nil
+	case KeyStoreBolt:
+		if location == "" {
+			location = path.Join(secureGateKeysDir, "keys.db")
+		}
+		return OpenBoltKeyStore(location)
+	default:
+		return nil, fmt.Errorf("unsupported key store %s", kind)
+	}
+}
+
+// FileKeyStore stores the key pairs of each user in a directory named after
+// him, like OpenSSH: the private key in a file named after the pair and the
+// public key in the same file with a ".pub" suffix.
+// Directories are only accessible by their owner and files only readable
+// and writable by him.
+type FileKeyStore struct {
+	// Directory of the directories of the users
+	Dir string
+}
+
+// NewFileKeyStore creates a key store storing key pairs under dir.
+func NewFileKeyStore(dir string) *FileKeyStore {
+	return &FileKeyStore{Dir: dir}
+}
+
+func (s *FileKeyStore) userDir(userID string) string {
+	return path.Join(s.Dir, userID)
+}
+
+// Keys returns the names of the key pairs of the user.
+// Pairs stored with looser permissions by previous versions are tightened.
+func (s *FileKeyStore) Keys(userID string) ([]string, error) {
+	dir := s.userDir(userID)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if f.Mode().Perm() != 0600 {
+			if err := os.Chmod(path.Join(dir, f.Name()), 0600); err != nil {
+				return nil, err
+			}
+		}
+		if strings.HasSuffix(f.Name(), ".pub") || strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		names = append(names, f.Name())
+	}
+	return names, nil
+}
+
+// Get returns the key pair of the user stored under the given name,
+// or ErrKeyNotFound.
+func (s *FileKeyStore) Get(userID, name string) (KeyPair, error) {
+	keyPath := path.Join(s.userDir(userID), name)
+	info, err := os.Stat(keyPath)
+	if os.IsNotExist(err) {
+		return KeyPair{}, ErrKeyNotFound
+	}
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	privateKey, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	publicKey, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return KeyPair{}, err
+	}
+	return KeyPair{
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		Created:    info.ModTime(),
+	}, nil
+}
+
+// Put stores the key pair of the user under the given name,
+// replacing the pair stored under this name if any.
+// The creation time of the pair is kept as the modification
+// time of the private key.
+func (s *FileKeyStore) Put(userID, name string, pair KeyPair) error {
+	dir := s.userDir(userID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "could not create directory to store ssh keys")
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+
+	keyPath := path.Join(dir, name)
+	if err := writeFileAtomic(keyPath+".pub", pair.PublicKey); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyPath, pair.PrivateKey); err != nil {
+		return err
+	}
+	if !pair.Created.IsZero() {
+		return os.Chtimes(keyPath, time.Now(), pair.Created)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at once,
+// only readable and writable by its owner.
+func writeFileAtomic(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Rename moves the key pair of the user stored under from to to.
+func (s *FileKeyStore) Rename(userID, from, to string) error {
+	dir := s.userDir(userID)
+	if err := os.Rename(path.Join(dir, from)+".pub", path.Join(dir, to)+".pub"); err != nil {
+		return err
+	}
+	return os.Rename(path.Join(dir, from), path.Join(dir, to))
+}
+
+// Delete removes the key pair of the user stored under the given name.
+func (s *FileKeyStore) Delete(userID, name string) error {
+	keyPath := path.Join(s.userDir(userID), name)
+	if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(keyPath + ".pub"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Close does nothing, files are not kept open.
+func (s *FileKeyStore) Close() error {
+	return nil
+}
+
+// BoltKeyStore stores the key pairs in a Bolt database only readable and
+// writable by its owner, in a bucket per user.
+type BoltKeyStore struct {
+	// Database file
+	Path string
+
+	// contains filtered or unexported fields
+	db *bolt.DB
+}
+
+// OpenBoltKeyStore opens the key store database located at the given path
+// or creates it if none exist.
+func OpenBoltKeyStore(dbPath string) (*BoltKeyStore, error) {
+	if err := os.MkdirAll(path.Dir(dbPath), 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create directory to store ssh keys")
+	}
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open the key store located in: %s", dbPath)
+	}
+	if err := os.Chmod(dbPath, 0600); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltKeyStore{Path: dbPath, db: db}, nil
+}
+
+// Keys returns the names of the key pairs of the user.
+func (s *BoltKeyStore) Keys(userID string) ([]string, error) {
+	var names []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(userID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns the key pair of the user stored under the given name,
+// or ErrKeyNotFound.
+func (s *BoltKeyStore) Get(userID, name string) (KeyPair, error) {
+	var pair KeyPair
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(userID))
+		if b == nil {
+			return ErrKeyNotFound
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+
+		// Struct values in the database are stored as JSON.
+		return json.Unmarshal(v, &pair)
+	})
+	if err != nil {
+		return KeyPair{}, err
+	}
+	return pair, nil
+}
+
+// Put stores the key pair of the user under the given name,
+// replacing the pair stored under this name if any.
+func (s *BoltKeyStore) Put(userID, name string, pair KeyPair) error {
+	if pair.Created.IsZero() {
+		pair.Created = time.Now()
+	}
+	v, err := json.Marshal(&pair)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(userID))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+}
+
+// Rename moves the key pair of the user stored under from to to.
+func (s *BoltKeyStore) Rename(userID, from, to string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(userID))
+		if b == nil {
+			return ErrKeyNotFound
+		}
+		v := b.Get([]byte(from))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		// Copy the value, it is only valid until it is deleted
+		v = append([]byte(nil), v...)
+		if err := b.Delete([]byte(from)); err != nil {
+			return err
+		}
+		return b.Put([]byte(to), v)
+	})
+}
+
+// Delete removes the key pair of the user stored under the given name.
+func (s *BoltKeyStore) Delete(userID, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(userID))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// Close closes the database.
+func (s *BoltKeyStore) Close() error {
+	return s.db.Close()
+}
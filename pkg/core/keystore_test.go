@@ -0,0 +1,121 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tt := []struct {
+		name     string
+		kind     string
+		location string
+	}{
+		{
+			name:     "file",
+			kind:     KeyStoreFile,
+			location: path.Join(dir, "files"),
+		},
+		{
+			name:     "bolt",
+			kind:     KeyStoreBolt,
+			location: path.Join(dir, "bolt", "keys.db"),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			store, err := OpenKeyStore(tc.kind, tc.location)
+			assert.NoError(err)
+			defer store.Close()
+
+			names, err := store.Keys("foobar")
+			assert.NoError(err)
+			assert.Empty(names)
+			_, err = store.Get("foobar", "id_ed25519")
+			assert.Equal(ErrKeyNotFound, err)
+
+			pair, err := generateSSHKeyPair(KeyTypeEd25519, nil)
+			assert.NoError(err)
+			pair.Created = time.Now().Add(-time.Hour).Truncate(time.Second)
+			assert.NoError(store.Put("foobar", "id_ed25519.new", pair))
+			assert.NoError(store.Put("barfoo", "id_rsa", pair))
+
+			got, err := store.Get("foobar", "id_ed25519.new")
+			assert.NoError(err)
+			assert.Equal(pair.PrivateKey, got.PrivateKey)
+			assert.Equal(pair.PublicKey, got.PublicKey)
+			assert.True(pair.Created.Equal(got.Created))
+
+			// Renamed pairs keep their creation time
+			assert.NoError(store.Rename("foobar", "id_ed25519.new", "id_ed25519"))
+			names, err = store.Keys("foobar")
+			assert.NoError(err)
+			assert.Equal([]string{"id_ed25519"}, names)
+			got, err = store.Get("foobar", "id_ed25519")
+			assert.NoError(err)
+			assert.True(pair.Created.Equal(got.Created))
+
+			// Pairs are replaced
+			other, err := generateSSHKeyPair(KeyTypeEd25519, nil)
+			assert.NoError(err)
+			assert.NoError(store.Put("foobar", "id_ed25519", other))
+			got, err = store.Get("foobar", "id_ed25519")
+			assert.NoError(err)
+			assert.Equal(other.PublicKey, got.PublicKey)
+
+			assert.NoError(store.Delete("foobar", "id_ed25519"))
+			assert.NoError(store.Delete("foobar", "id_ed25519"))
+			names, err = store.Keys("foobar")
+			assert.NoError(err)
+			assert.Empty(names)
+
+			// Other users are not concerned
+			names, err = store.Keys("barfoo")
+			assert.NoError(err)
+			assert.Equal([]string{"id_rsa"}, names)
+		})
+	}
+}
+
+func TestFileKeyStorePermissions(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Keys written by previous versions
+	writeLegacyKey(t, path.Join(dir, "foobar", "id_rsa"))
+	assert.NoError(os.Chmod(path.Join(dir, "foobar"), os.ModePerm))
+
+	store := NewFileKeyStore(dir)
+	names, err := store.Keys("foobar")
+	assert.NoError(err)
+	assert.Equal([]string{"id_rsa"}, names)
+
+	info, err := os.Stat(path.Join(dir, "foobar"))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), info.Mode().Perm())
+	for _, name := range []string{"id_rsa", "id_rsa.pub"} {
+		info, err := os.Stat(path.Join(dir, "foobar", name))
+		assert.NoError(err)
+		assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestOpenKeyStore(t *testing.T) {
+	_, err := OpenKeyStore("vault", "")
+	require.EqualError(t, err, "unsupported key store vault")
+}
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"golang.org/x/crypto/ssh"
+)
+
+// PooledClient is an SSH connection of the pool leased to a command.
+// It must be released once the command does not need it anymore.
+// Closing it closes the connection for every command using it.
+type PooledClient struct {
+	*ssh.Client
+
+	pool  *connPool
+	id    string
+	entry *poolEntry
+	once  sync.Once
+}
+
+// Release gives the connection back to the pool.
+func (c *PooledClient) Release() {
+	c.once.Do(func() {
+		c.pool.release(c.id, c.entry)
+	})
+}
+
+// Close closes the connection for every command using it, and the
+// pool forgets it right away so that it dials a new one next time.
+func (c *PooledClient) Close() error {
+	c.pool.forget(c.id, c.entry)
+	return nil
+}
+
+// Connect returns an SSH connection with the machine, reusing the one
+// of the pool if it is still alive and dialing a new one otherwise.
+// Connections released by every command are closed once idle for the
+// configured duration.
+func (core *SecureGateCore) Connect(ctx context.Context, machine backend.Machine) (*PooledClient, error) {
+	chain, err := core.JumpChain(machine)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections are only reused to reach the machine the same way.
+	var hops, jumps []string
+	for _, hop := range chain {
+		hops = append(hops, fmt.Sprintf("%s@%s", core.Account(hop), sshAddr(hop)))
+		if hop.ID != machine.ID {
+			jumps = append(jumps, hop.ID)
+		}
+	}
+	route := strings.Join(hops, ",")
+
+	return core.pool.get(machine.ID, route, jumps, core.Config.ConnectionIdleTimeout, func() (*ssh.Client, error) {
+		return core.Dial(ctx, machine)
+	})
+}
+
+// connPool keeps the SSH connections with machines, by machine ID,
+// to reuse them across commands.
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*poolEntry
+	// Replaced connections still in use, closed once released.
+	replaced map[*poolEntry]string
+}
+
+// poolEntry is a connection of the pool.
+type poolEntry struct {
+	client      *ssh.Client
+	route       string        // how the machine is reached
+	jumps       []string      // IDs of the jump hosts of the route
+	idleTimeout time.Duration // not kept once idle if not positive
+	users       int           // number of commands using the connection
+	closed      bool          // the connection is closed
+	timer       *time.Timer   // expires the connection while idle
+}
+
+func newConnPool() *connPool {
+	return &connPool{
+		conns:    make(map[string]*poolEntry),
+		replaced: make(map[*poolEntry]string),
+	}
+}
+
+// get leases the connection of the pool with the machine if it reaches
+// it through route, or dials a new one going through the jump hosts.
+func (p *connPool) get(id, route string, jumps []string, idleTimeout time.Duration, dial func() (*ssh.Client, error)) (*PooledClient, error) {
+	p.mu.Lock()
+	if e, ok := p.conns[id]; ok && !e.closed && e.route == route {
+		e.users++
+		if e.timer != nil {
+			e.timer.Stop()
+			e.timer = nil
+		}
+		p.mu.Unlock()
+		return &PooledClient{Client: e.client, pool: p, id: id, entry: e}, nil
+	}
+	p.mu.Unlock()
+
+	// Dial without holding the lock to not delay other machines.
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := &poolEntry{client: client, route: route, jumps: jumps, idleTimeout: idleTimeout, users: 1}
+	// A replaced connection is closed once unused.
+	if old, ok := p.conns[id]; ok {
+		if old.users == 0 {
+			old.close()
+		} else {
+			p.replaced[old] = id
+		}
+	}
+	p.conns[id] = e
+
+	// Forget the connection as soon as it is closed.
+	go func() {
+		client.Wait()
+		p.forget(id, e)
+	}()
+
+	return &PooledClient{Client: client, pool: p, id: id, entry: e}, nil
+}
+
+// release gives back a leased connection and closes it
+// once idle for too long, or right away if it was replaced.
+func (p *connPool) release(id string, e *poolEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.users--
+	if e.users > 0 || e.closed {
+		return
+	}
+	if p.conns[id] != e || e.idleTimeout <= 0 {
+		p.remove(id, e)
+		return
+	}
+	e.timer = time.AfterFunc(e.idleTimeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if e.users == 0 {
+			p.remove(id, e)
+		}
+	})
+}
+
+// forget closes the connection and removes it from the pool.
+func (p *connPool) forget(id string, e *poolEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remove(id, e)
+}
+
+// remove closes the connection and removes it from the pool,
+// which must be locked.
+func (p *connPool) remove(id string, e *poolEntry) {
+	e.close()
+	if p.conns[id] == e {
+		delete(p.conns, id)
+	}
+	delete(p.replaced, e)
+}
+
+// close closes the connections with the machine and the ones
+// going through it as a jump host, even if in use.
+func (p *connPool) close(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for machineID, e := range p.conns {
+		if machineID == id || e.goesThrough(id) {
+			p.remove(machineID, e)
+		}
+	}
+	for e, machineID := range p.replaced {
+		if machineID == id || e.goesThrough(id) {
+			p.remove(machineID, e)
+		}
+	}
+}
+
+// closeAll closes every connection of the pool, even if in use.
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, e := range p.conns {
+		p.remove(id, e)
+	}
+	for e, id := range p.replaced {
+		p.remove(id, e)
+	}
+}
+
+// goesThrough reports whether the connection goes through
+// the machine with the given ID as a jump host.
+func (e *poolEntry) goesThrough(id string) bool {
+	for _, jump := range e.jumps {
+		if jump == id {
+			return true
+		}
+	}
+	return false
+}
+
+// close closes the connection. The pool must be locked.
+func (e *poolEntry) close() {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	if !e.closed {
+		e.closed = true
+		e.client.Close()
+	}
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialServer returns a dial function connecting to an in-process
+// SSH server, counting how many connections were dialed.
+func dialServer(t *testing.T, dialed *int) func() (*ssh.Client, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	return func() (*ssh.Client, error) {
+		*dialed++
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer listener.Close()
+
+		go func() {
+			serverSide, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			config := &ssh.ServerConfig{NoClientAuth: true}
+			config.AddHostKey(hostKey)
+			conn, chans, reqs, err := ssh.NewServerConn(serverSide, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "no channels")
+			}
+			conn.Close()
+		}()
+
+		return ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            "test",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+}
+
+// closed reports whether the connection gets closed shortly.
+func closed(client *ssh.Client) bool {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	assert := require.New(t)
+
+	var dialed int
+	dial := dialServer(t, &dialed)
+	pool := newConnPool()
+
+	first, err := pool.get("1", "user@1.1.1.1:22", nil, time.Minute, dial)
+	assert.NoError(err)
+	second, err := pool.get("1", "user@1.1.1.1:22", nil, time.Minute, dial)
+	assert.NoError(err)
+	assert.Equal(1, dialed)
+	assert.Equal(first.Client, second.Client)
+
+	// Another machine gets its own connection
+	other, err := pool.get("2", "user@2.2.2.2:22", nil, time.Minute, dial)
+	assert.NoError(err)
+	assert.Equal(2, dialed)
+	assert.NotEqual(first.Client, other.Client)
+
+	// Kept while idle, then reused
+	first.Release()
+	second.Release()
+	second.Release()
+	third, err := pool.get("1", "user@1.1.1.1:22", nil, time.Minute, dial)
+	assert.NoError(err)
+	assert.Equal(2, dialed)
+	assert.Equal(first.Client, third.Client)
+
+	// A new route replaces the connection once released
+	rerouted, err := pool.get("1", "user@3.3.3.3:22,user@1.1.1.1:22", nil, time.Minute, dial)
+	assert.NoError(err)
+	assert.Equal(3, dialed)
+	assert.NotEqual(first.Client, rerouted.Client)
+	third.Release()
+	assert.True(closed(first.Client))
+
+	// A closed connection is dialed again
+	rerouted.Close()
+	assert.True(closed(rerouted.Client))
+	again, err := pool.get("1", "user@3.3.3.3:22,user@1.1.1.1:22", nil, time.Minute, dial)
+	assert.NoError(err)
+	assert.Equal(4, dialed)
+	again.Release()
+	other.Release()
+}
+
+func TestPoolExpiry(t *testing.T) {
+	assert := require.New(t)
+
+	var dialed int
+	dial := dialServer(t, &dialed)
+	pool := newConnPool()
+
+	// Not kept at all without idle timeout
+	client, err := pool.get("1", "route", nil, 0, dial)
+	assert.NoError(err)
+	client.Release()
+	assert.True(closed(client.Client))
+
+	// Closed once idle for too long
+	client, err = pool.get("1", "route", nil, 50*time.Millisecond, dial)
+	assert.NoError(err)
+	assert.False(closed(client.Client))
+	client.Release()
+	assert.True(closed(client.Client))
+	assert.Equal(2, dialed)
+}
+
+func TestPoolClose(t *testing.T) {
+	assert := require.New(t)
+
+	var dialed int
+	dial := dialServer(t, &dialed)
+	pool := newConnPool()
+
+	first, err := pool.get("1", "route", nil, time.Minute, dial)
+	assert.NoError(err)
+	second, err := pool.get("2", "route", nil, time.Minute, dial)
+	assert.NoError(err)
+	third, err := pool.get("3", "route", nil, time.Minute, dial)
+	assert.NoError(err)
+	third.Release()
+	jumped, err := pool.get("4", "route", []string{"5", "1"}, time.Minute, dial)
+	assert.NoError(err)
+
+	// Lost access to a machine, even while in use,
+	// or used as a jump host
+	pool.close("1")
+	assert.True(closed(first.Client))
+	assert.True(closed(jumped.Client))
+	assert.False(closed(second.Client))
+	first.Release()
+	jumped.Release()
+
+	// Signed out
+	pool.closeAll()
+	assert.True(closed(second.Client))
+	assert.True(closed(third.Client))
+	second.Release()
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gusmin/gate/pkg/backend"
+)
+
+// AmbiguousMachineError is returned when a reference matches several machines.
+type AmbiguousMachineError struct {
+	Reference  string
+	Candidates []backend.Machine
+}
+
+func (e *AmbiguousMachineError) Error() string {
+	return fmt.Sprintf("%s matches %d accessible machines", e.Reference, len(e.Candidates))
+}
+
+// UnknownMachineError is returned when a reference matches no machine.
+type UnknownMachineError struct {
+	Reference string
+	// Names of the machines close to the reference, closest first.
+	Suggestions []string
+}
+
+func (e *UnknownMachineError) Error() string {
+	msg := fmt.Sprintf("%s is not part of accessible machines", e.Reference)
+	if len(e.Suggestions) > 0 {
+		msg += fmt.Sprintf(", did you mean %s?", strings.Join(e.Suggestions, " or "))
+	}
+	return msg
+}
+
+// maxSuggestions bounds the suggestions of an UnknownMachineError.
+const maxSuggestions = 3
+
+// ResolveMachine returns the accessible machine the reference designates.
+// The reference is matched, in this order, against the ID, the name and
+// the IP of the machines, then against the beginning of their ID or name.
+// The first of these which matches decides, and must match a single machine.
+func (core *SecureGateCore) ResolveMachine(ref string) (backend.Machine, error) {
+	return ResolveMachine(ref, core.Machines())
+}
+
+// ResolveMachine returns the machine the reference designates among the given ones.
+// See SecureGateCore.ResolveMachine.
+func ResolveMachine(ref string, machines []backend.Machine) (backend.Machine, error) {
+	matchers := []func(m backend.Machine) bool{
+		func(m backend.Machine) bool { return m.ID == ref },
+		func(m backend.Machine) bool { return m.Name == ref },
+		func(m backend.Machine) bool { return m.IP == ref },
+		func(m backend.Machine) bool {
+			return ref != "" && (strings.HasPrefix(m.ID, ref) || strings.HasPrefix(m.Name, ref))
+		},
+	}
+
+	for _, match := range matchers {
+		var candidates []backend.Machine
+		for _, m := range machines {
+			if match(m) {
+				candidates = append(candidates, m)
+			}
+		}
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			return candidates[0], nil
+		default:
+			return backend.Machine{}, &AmbiguousMachineError{Reference: ref, Candidates: candidates}
+		}
+	}
+
+	return backend.Machine{}, &UnknownMachineError{Reference: ref, Suggestions: suggestMachines(ref, machines)}
+}
+
+// MachineReferences returns a reference resolving to each of the accessible
+// machines: its name, or its ID when the name is shared with other machines.
+func (core *SecureGateCore) MachineReferences() []string {
+	machines := core.Machines()
+
+	var refs []string
+	for _, m := range machines {
+		if resolved, err := ResolveMachine(m.Name, machines); err == nil && resolved.ID == m.ID {
+			refs = append(refs, m.Name)
+		} else {
+			refs = append(refs, m.ID)
+		}
+	}
+	return refs
+}
+
+// suggestMachines returns the names of the machines close enough
+// to the reference to be a typo of it, closest first.
+func suggestMachines(ref string, machines []backend.Machine) []string {
+	// Allow about one typo every three characters.
+	maxDistance := len(ref) / 3
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	var suggestions []suggestion
+	seen := make(map[string]bool)
+	for _, m := range machines {
+		if seen[m.Name] {
+			continue
+		}
+		seen[m.Name] = true
+		d := levenshtein(strings.ToLower(ref), strings.ToLower(m.Name))
+		if d <= maxDistance {
+			suggestions = append(suggestions, suggestion{m.Name, d})
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].distance < suggestions[j].distance
+	})
+
+	var names []string
+	for i := 0; i < len(suggestions) && i < maxSuggestions; i++ {
+		names = append(names, suggestions[i].name)
+	}
+	return names
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
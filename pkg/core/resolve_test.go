@@ -0,0 +1,110 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveMachine(t *testing.T) {
+	assert := require.New(t)
+
+	machines := []backend.Machine{
+		{ID: "09gtWjWi9SOVSGb1", Name: "NASA", IP: "10.0.0.1"},
+		{ID: "VexuCBYu0JOHzy84", Name: "AREA-51", IP: "10.0.0.2"},
+		{ID: "kKQSHWF2cl1pjZdp", Name: "web", IP: "10.0.0.3"},
+		{ID: "kKQSHWF2cl1pjZdq", Name: "web", IP: "10.0.0.4"},
+		{ID: "AREA-52", Name: "AREA-52-backup", IP: "10.0.0.5"},
+	}
+
+	tt := []struct {
+		name       string
+		ref        string
+		expected   backend.Machine
+		candidates []backend.Machine
+		err        string
+	}{
+		{
+			name:     "id",
+			ref:      "VexuCBYu0JOHzy84",
+			expected: machines[1],
+		},
+		{
+			name:     "id before name",
+			ref:      "AREA-52",
+			expected: machines[4],
+		},
+		{
+			name:     "name",
+			ref:      "NASA",
+			expected: machines[0],
+		},
+		{
+			name:       "shared name",
+			ref:        "web",
+			candidates: machines[2:4],
+			err:        "web matches 2 accessible machines",
+		},
+		{
+			name:     "ip",
+			ref:      "10.0.0.4",
+			expected: machines[3],
+		},
+		{
+			name:     "unique prefix",
+			ref:      "NA",
+			expected: machines[0],
+		},
+		{
+			name:       "ambiguous prefix",
+			ref:        "AREA",
+			candidates: []backend.Machine{machines[1], machines[4]},
+			err:        "AREA matches 2 accessible machines",
+		},
+		{
+			name: "typo",
+			ref:  "NSA",
+			err:  "NSA is not part of accessible machines, did you mean NASA?",
+		},
+		{
+			name: "typos",
+			ref:  "area-50",
+			err:  "area-50 is not part of accessible machines, did you mean AREA-51?",
+		},
+		{
+			name: "unknown",
+			ref:  "nowhere",
+			err:  "nowhere is not part of accessible machines",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			machine, err := ResolveMachine(tc.ref, machines)
+			if tc.err != "" {
+				assert.EqualError(err, tc.err)
+				if tc.candidates != nil {
+					assert.Equal(tc.candidates, err.(*AmbiguousMachineError).Candidates)
+				}
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expected, machine)
+		})
+	}
+}
+
+func TestMachineReferences(t *testing.T) {
+	assert := require.New(t)
+
+	core := New("", nil, nil, logrus.StandardLogger(), &mockTranslator{}, nil)
+	core.session.machines.set([]backend.Machine{
+		{ID: "1", Name: "NASA"},
+		{ID: "2", Name: "web"},
+		{ID: "3", Name: "web"},
+	})
+
+	assert.Equal([]string{"NASA", "2", "3"}, core.MachineReferences())
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/database"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RotateSSHKey replaces the SSH key of the user by a new one, or resumes
+// the unfinished rotation of the key.
+// The new key is registered in the agents of every machine the user has
+// access to before being used, then the old key is unregistered from them.
+// The progress is saved in the database, so a rotation failing on some
+// agents is resumed later without locking the user out of any machine.
+func (core *SecureGateCore) RotateSSHKey(ctx context.Context) error {
+	if _, name := core.session.key(); ephemeralKey(name) {
+		return errors.New("ephemeral keys are not rotated, a new one is used at each login")
+	}
+	if core.externalKey() {
+		return fmt.Errorf("keys from %s are not rotated by the gate", core.keySource())
+	}
+
+	core.keysMu.Lock()
+	defer core.keysMu.Unlock()
+
+	userID := core.User().ID
+	rotation, err := core.DB.GetKeyRotation(userID)
+	if err == database.ErrNotFound {
+		pending, err := core.pendingKeyName()
+		if err != nil {
+			return err
+		}
+		// Reuse the key of an interrupted migration.
+		_, err = core.Keys.Get(userID, pending)
+		if err == ErrKeyNotFound {
+			pair, err := generateSSHKeyPair(core.keyType(), core.session.encryptionKey)
+			if err != nil {
+				return errors.Wrap(err, "could not generate ssh key pair")
+			}
+			if err := core.Keys.Put(userID, pending, pair); err != nil {
+				return errors.Wrap(err, "could not store ssh key pair")
+			}
+		} else if err != nil {
+			return err
+		}
+		rotation = database.KeyRotation{UserID: userID, Started: time.Now()}
+		if err := core.DB.UpsertKeyRotation(rotation); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return core.resumeKeyRotation(ctx, rotation)
+}
+
+// KeyFingerprint returns the SHA256 fingerprint of the SSH key of the user.
+func (core *SecureGateCore) KeyFingerprint() string {
+	pubKey, _ := core.session.key()
+	return HostKeyFingerprint(string(pubKey))
+}
+
+// pendingKeyName returns the name the new key of a rotation is stored
+// under, the one of the key of the configured type it becomes once used.
+func (core *SecureGateCore) pendingKeyName() (string, error) {
+	name, err := keyFileName(core.keyType())
+	if err != nil {
+		return "", err
+	}
+	return name + ".new", nil
+}
+
+// resumeKeyRotation carries on the rotation where it stopped.
+// keysMu must be held.
+func (core *SecureGateCore) resumeKeyRotation(ctx context.Context, rotation database.KeyRotation) error {
+	logFn := core.Logger.WithFields(logrus.Fields{
+		"user": core.User().ID,
+	})
+
+	if rotation.OldKey == "" {
+		pending, err := core.pendingKeyName()
+		if err != nil {
+			return err
+		}
+		pub, _, err := core.publicKey(pending)
+		if err != nil {
+			// Nothing to resume, the next rotation starts over.
+			core.DB.DeleteKeyRotation(rotation.UserID)
+			return errors.Wrap(err, "could not read new public ssh key")
+		}
+
+		machines, err := core.registeredMachines()
+		if err != nil {
+			return err
+		}
+		accessible := make(map[string]bool)
+		for _, m := range machines {
+			accessible[m.ID] = true
+		}
+
+		// Register the new key where it is missing
+		registered := make(map[string]bool)
+		var kept []database.Machine
+		for _, m := range rotation.Registered {
+			if !accessible[m.ID] {
+				// Access lost meanwhile, the key has nothing to do there anymore.
+				err := core.deleteKeyFromAgent(ctx, rotation.UserID, transformInBackendMachines([]database.Machine{m})[0], pub)
+				if err != nil {
+					logFn.Warnf("Could not unregister key in %s: %v\n", m.Name, err)
+				}
+				continue
+			}
+			registered[m.ID] = true
+			kept = append(kept, m)
+		}
+		rotation.Registered = kept
+
+		var failed []string
+		for _, m := range machines {
+			if registered[m.ID] {
+				continue
+			}
+			if err := core.sendKeyToAgent(ctx, m, pub); err != nil {
+				failed = append(failed, m.Name)
+				continue
+			}
+			rotation.Registered = append(rotation.Registered, transformInDBMachines([]backend.Machine{m})...)
+		}
+		if err := core.DB.UpsertKeyRotation(rotation); err != nil {
+			return err
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("new key not confirmed by %s", strings.Join(failed, ", "))
+		}
+
+		// Every agent knows the new key, switch to it
+		oldPubKey, oldKeyName := core.session.key()
+		keyName := strings.TrimSuffix(pending, ".new")
+		if err := core.Keys.Rename(rotation.UserID, pending, keyName); err != nil {
+			return errors.Wrap(err, "could not move new ssh key")
+		}
+		if keyName != oldKeyName {
+			if err := core.Keys.Delete(rotation.UserID, oldKeyName); err != nil {
+				logFn.Warnf("Could not delete SSH key %s: %v\n", oldKeyName, err)
+			}
+		}
+		core.session.setKey(pub, keyName)
+
+		rotation.OldKey = string(oldPubKey)
+		rotation.Unregister = rotation.Registered
+		if err := core.DB.UpsertKeyRotation(rotation); err != nil {
+			return err
+		}
+		logFn.Warnf("Rotated SSH key, %s replaced by %s\n",
+			HostKeyFingerprint(rotation.OldKey), HostKeyFingerprint(string(pub)))
+	}
+
+	// Unregister the old key
+	var left []database.Machine
+	var failed []string
+	for _, m := range rotation.Unregister {
+		err := core.deleteKeyFromAgent(ctx, rotation.UserID, transformInBackendMachines([]database.Machine{m})[0], []byte(rotation.OldKey))
+		if err != nil {
+			left = append(left, m)
+			failed = append(failed, m.Name)
+		}
+	}
+	if len(left) > 0 {
+		rotation.Unregister = left
+		if err := core.DB.UpsertKeyRotation(rotation); err != nil {
+			return err
+		}
+		return fmt.Errorf("old key not unregistered from %s", strings.Join(failed, ", "))
+	}
+
+	return core.DB.DeleteKeyRotation(rotation.UserID)
+}
+
+// rotateSSHKeyIfNeeded resumes the unfinished rotation of the SSH key of
+// the user, or starts one if the key is older than the configured maximum
+// age. Rotation failures are only logged since they are retried later.
+func (core *SecureGateCore) rotateSSHKeyIfNeeded(ctx context.Context) error {
+	// Skip if the previous check is still running.
+	if !atomic.CompareAndSwapInt32(&core.rotating, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&core.rotating, 0)
+
+	if _, name := core.session.key(); ephemeralKey(name) || core.externalKey() {
+		return nil
+	}
+
+	_, err := core.DB.GetKeyRotation(core.User().ID)
+	if err == database.ErrNotFound {
+		if core.Config.KeyMaxAge <= 0 {
+			return nil
+		}
+		_, keyName := core.session.key()
+		pair, err := core.Keys.Get(core.User().ID, keyName)
+		if err != nil {
+			return err
+		}
+		if time.Since(pair.Created) < core.Config.KeyMaxAge {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := core.RotateSSHKey(ctx); err != nil {
+		core.Logger.WithFields(logrus.Fields{
+			"user": core.User().ID,
+		}).Warnf("Could not rotate SSH key: %v\n", err)
+	}
+	return nil
+}
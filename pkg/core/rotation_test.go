@@ -0,0 +1,140 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/gusmin/gate/pkg/config"
+	"github.com/gusmin/gate/pkg/database"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// newRotationCore returns a core whose user has a key in a temporary
+// directory registered in the agents of two machines.
+func newRotationCore(t *testing.T, agentClient *keyringAgentClient) (*SecureGateCore, func()) {
+	dir, err := ioutil.TempDir("", "keys")
+	require.NoError(t, err)
+
+	core := New(
+		"",
+		nil,
+		agentClient,
+		logrus.StandardLogger(),
+		&mockTranslator{},
+		&mockDatabaseRepository{
+			db: map[string]database.User{
+				"foobar": {ID: "foobar", Machines: []database.Machine{
+					{ID: "1", Name: "web", IP: "foo", AgentPort: 3000},
+					{ID: "2", Name: "db", IP: "bar", AgentPort: 3000},
+				}},
+			},
+			rotations: map[string]database.KeyRotation{},
+		},
+	)
+	core.Config = config.Configuration{KeyType: KeyTypeEd25519}
+	core.Keys = NewFileKeyStore(dir)
+	core.session.user.set(backend.User{ID: "foobar"})
+	require.NoError(t, core.initSSHKeys())
+	require.NoError(t, core.loadPublicSSHKey(core.session.keyName))
+	for _, endpoint := range []string{"https://foo:3000", "https://bar:3000"} {
+		agentClient.keys[endpoint] = map[string]bool{string(core.session.pubKey): true}
+	}
+
+	return core, func() { os.RemoveAll(dir) }
+}
+
+func TestRotateSSHKey(t *testing.T) {
+	assert := require.New(t)
+
+	agentClient := &keyringAgentClient{
+		keys: map[string]map[string]bool{},
+		down: map[string]bool{"https://bar:3000": true},
+	}
+	core, cleanup := newRotationCore(t, agentClient)
+	defer cleanup()
+	oldPubKey, keyName := core.session.key()
+	repo := core.DB.(*mockDatabaseRepository)
+
+	// The key is kept while an agent did not confirm the new one
+	err := core.RotateSSHKey(context.Background())
+	assert.EqualError(err, "new key not confirmed by db")
+	pubKey, _ := core.session.key()
+	assert.Equal(oldPubKey, pubKey)
+	assert.Len(repo.rotations["foobar"].Registered, 1)
+	assert.Empty(repo.rotations["foobar"].OldKey)
+	pending, _, err := core.publicKey(keyName + ".new")
+	assert.NoError(err)
+	assert.True(agentClient.keys["https://foo:3000"][string(pending)])
+
+	// The new key is used once every agent confirmed
+	delete(agentClient.down, "https://bar:3000")
+	agentClient.down["https://foo:3000"] = true
+	err = core.RotateSSHKey(context.Background())
+	assert.EqualError(err, "old key not unregistered from web")
+	pubKey, _ = core.session.key()
+	assert.Equal(pending, pubKey)
+	assert.True(agentClient.keys["https://bar:3000"][string(pending)])
+	assert.False(agentClient.keys["https://bar:3000"][string(oldPubKey)])
+	_, err = core.Keys.Get("foobar", keyName+".new")
+	assert.Equal(ErrKeyNotFound, err)
+	signer, err := core.keySigner(keyName)
+	assert.NoError(err)
+	assert.Equal(string(pending), string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	assert.Equal(string(oldPubKey), repo.rotations["foobar"].OldKey)
+
+	// and the rotation finishes later
+	delete(agentClient.down, "https://foo:3000")
+	assert.NoError(core.RotateSSHKey(context.Background()))
+	assert.False(agentClient.keys["https://foo:3000"][string(oldPubKey)])
+	assert.True(agentClient.keys["https://foo:3000"][string(pending)])
+	assert.Empty(repo.rotations)
+}
+
+func TestRotateSSHKeyIfNeeded(t *testing.T) {
+	assert := require.New(t)
+
+	agentClient := &keyringAgentClient{keys: map[string]map[string]bool{}}
+	core, cleanup := newRotationCore(t, agentClient)
+	defer cleanup()
+	oldPubKey, keyName := core.session.key()
+
+	// Rotation disabled
+	pair, err := core.Keys.Get("foobar", keyName)
+	assert.NoError(err)
+	pair.Created = time.Now().Add(-48 * time.Hour)
+	assert.NoError(core.Keys.Put("foobar", keyName, pair))
+	assert.NoError(core.rotateSSHKeyIfNeeded(context.Background()))
+	pubKey, _ := core.session.key()
+	assert.Equal(oldPubKey, pubKey)
+
+	// Key young enough
+	core.Config.KeyMaxAge = 72 * time.Hour
+	assert.NoError(core.rotateSSHKeyIfNeeded(context.Background()))
+	pubKey, _ = core.session.key()
+	assert.Equal(oldPubKey, pubKey)
+
+	// Key too old
+	core.Config.KeyMaxAge = 24 * time.Hour
+	assert.NoError(core.rotateSSHKeyIfNeeded(context.Background()))
+	pubKey, _ = core.session.key()
+	assert.NotEqual(oldPubKey, pubKey)
+	assert.True(agentClient.keys["https://foo:3000"][string(pubKey)])
+	assert.False(agentClient.keys["https://foo:3000"][string(oldPubKey)])
+
+	// Unfinished rotations are resumed whatever the age of the key
+	oldPubKey = pubKey
+	agentClient.down = map[string]bool{"https://bar:3000": true}
+	assert.Error(core.RotateSSHKey(context.Background()))
+	core.Config.KeyMaxAge = 0
+	delete(agentClient.down, "https://bar:3000")
+	assert.NoError(core.rotateSSHKeyIfNeeded(context.Background()))
+	pubKey, _ = core.session.key()
+	assert.NotEqual(oldPubKey, pubKey)
+	assert.Empty(core.DB.(*mockDatabaseRepository).rotations)
+}
@@ -8,9 +8,15 @@ import (
 
 // session are the logged in user related informations.
 type session struct {
-	pubKey   []byte   // initialized in loadSSHPublickey
-	user     user     // updated during background polling
-	machines machines // updated during background polling
+	keyMu   sync.RWMutex // guards pubKey and keyName, switched by key rotations
+	pubKey  []byte       // initialized in loadSSHPublickey
+	keyName string       // key pair of the user in the key store, initialized at sign up
+	// Agent offering the key of the user, empty if in the key store
+	keySocket string
+	// Encrypts the private keys at rest, nil if stored in plaintext
+	encryptionKey []byte
+	user          user     // updated during background polling
+	machines      machines // updated during background polling
 }
 
 type machines struct {
@@ -46,3 +52,16 @@ func (u *user) set(user backend.User) {
 	defer u.mu.Unlock()
 	u.user = user
 }
+
+func (s *session) key() (pubKey []byte, keyName string) {
+	s.keyMu.RLock()
+	defer s.keyMu.RUnlock()
+	return s.pubKey, s.keyName
+}
+
+func (s *session) setKey(pubKey []byte, keyName string) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	s.pubKey = pubKey
+	s.keyName = keyName
+}
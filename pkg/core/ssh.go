@@ -0,0 +1,176 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Dial opens an SSH connection with the machine as the user's account on it.
+// The user is authenticated with his private key, or with a certificate of
+// it issued for the connection if the gate has a certificate authority,
+// and the host key of the machine is verified. Machines reachable only through other ones are
+// dialed by tunneling the connection through every jump host of the chain.
+// The context only bounds the connection setup.
+func (core *SecureGateCore) Dial(ctx context.Context, machine backend.Machine) (*ssh.Client, error) {
+	chain, err := core.JumpChain(machine)
+	if err != nil {
+		return nil, err
+	}
+
+	// Setup the config
+	signer, err := core.signer()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not make private key signer")
+	}
+
+	// Dial every hop through the previous one
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+	for _, hop := range chain {
+		hopSigner := signer
+		if core.CA != nil {
+			hopSigner, err = core.certificateSigner(signer, hop)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+		config := &ssh.ClientConfig{
+			User:            core.Account(hop),
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(hopSigner)},
+			HostKeyCallback: core.HostKeyCallback(hop),
+		}
+
+		var client *ssh.Client
+		if len(clients) == 0 {
+			client, err = dial(ctx, hop, config)
+		} else {
+			client, err = dialThrough(ctx, clients[len(clients)-1], hop, config)
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	// Tear down the jump hosts connections along with the last one
+	last := clients[len(clients)-1]
+	if len(clients) > 1 {
+		go func() {
+			last.Wait()
+			closeAll()
+		}()
+	}
+	return last, nil
+}
+
+// Account returns the remote account the user logs in as on the machine,
+// which is the configured SSH user unless the backend gives one.
+func (core *SecureGateCore) Account(machine backend.Machine) string {
+	if machine.Account != "" {
+		return machine.Account
+	}
+	return core.SSHUser
+}
+
+// JumpChain returns the machines to connect to in order to reach the machine,
+// starting with the one directly reachable and ending with the machine itself.
+// Every jump host must be accessible by the user and chains must not loop.
+func (core *SecureGateCore) JumpChain(machine backend.Machine) ([]backend.Machine, error) {
+	byID := make(map[string]backend.Machine)
+	for _, m := range core.Machines() {
+		byID[m.ID] = m
+	}
+
+	chain := []backend.Machine{machine}
+	seen := map[string]bool{machine.ID: true}
+	for hop := machine; hop.Via != ""; {
+		via, ok := byID[hop.Via]
+		if !ok {
+			return nil, fmt.Errorf("%s is reached via %s which is not part of accessible machines", hop.Name, hop.Via)
+		}
+		if seen[via.ID] {
+			return nil, fmt.Errorf("loop in the jump hosts of %s: %s", machine.Name, describeChain(append([]backend.Machine{via}, chain...)))
+		}
+		seen[via.ID] = true
+		chain = append([]backend.Machine{via}, chain...)
+		hop = via
+	}
+	return chain, nil
+}
+
+// describeChain formats a chain of machines as "first -> ... -> last".
+func describeChain(chain []backend.Machine) string {
+	names := make([]string, len(chain))
+	for i, m := range chain {
+		names[i] = m.Name
+	}
+	return strings.Join(names, " -> ")
+}
+
+// sshAddr returns the address of the SSH server of the machine.
+func sshAddr(machine backend.Machine) string {
+	return net.JoinHostPort(machine.IP, strconv.Itoa(machine.SSHPort))
+}
+
+// dial opens an SSH connection directly with the machine.
+func dial(ctx context.Context, machine backend.Machine, config *ssh.ClientConfig) (*ssh.Client, error) {
+	addr := sshAddr(machine)
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial with %s", machine.Name)
+	}
+
+	conn, err := handshake(ctx, netConn, addr, config)
+	if err != nil {
+		netConn.Close()
+		return nil, errors.Wrapf(err, "failed to dial with %s", machine.Name)
+	}
+	return conn, nil
+}
+
+// dialThrough opens an SSH connection with the machine tunneled
+// through a direct-tcpip channel of the jump host connection.
+func dialThrough(ctx context.Context, jump *ssh.Client, machine backend.Machine, config *ssh.ClientConfig) (*ssh.Client, error) {
+	addr := sshAddr(machine)
+	netConn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial with %s", machine.Name)
+	}
+
+	conn, err := handshake(ctx, netConn, addr, config)
+	if err != nil {
+		netConn.Close()
+		return nil, errors.Wrapf(err, "failed to dial with %s", machine.Name)
+	}
+	return conn, nil
+}
+
+// handshake establishes an SSH connection over netConn before the
+// context deadline if it has one.
+func handshake(ctx context.Context, netConn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+		defer netConn.SetDeadline(time.Time{})
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
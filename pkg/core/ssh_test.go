@@ -0,0 +1,78 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/gusmin/gate/pkg/backend"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJumpChain(t *testing.T) {
+	assert := require.New(t)
+
+	bastion := backend.Machine{ID: "1", Name: "bastion"}
+	relay := backend.Machine{ID: "2", Name: "relay", Via: "1"}
+	db := backend.Machine{ID: "3", Name: "db", Via: "2"}
+	hidden := backend.Machine{ID: "4", Name: "hidden", Via: "42"}
+	ping := backend.Machine{ID: "5", Name: "ping", Via: "6"}
+	pong := backend.Machine{ID: "6", Name: "pong", Via: "5"}
+	self := backend.Machine{ID: "7", Name: "self", Via: "7"}
+
+	tt := []struct {
+		name     string
+		machine  backend.Machine
+		expected []backend.Machine
+		err      string
+	}{
+		{
+			name:     "direct",
+			machine:  bastion,
+			expected: []backend.Machine{bastion},
+		},
+		{
+			name:     "multi-hop",
+			machine:  db,
+			expected: []backend.Machine{bastion, relay, db},
+		},
+		{
+			name:    "inaccessible jump host",
+			machine: hidden,
+			err:     "hidden is reached via 42 which is not part of accessible machines",
+		},
+		{
+			name:    "loop",
+			machine: ping,
+			err:     "loop in the jump hosts of ping: ping -> pong -> ping",
+		},
+		{
+			name:    "self loop",
+			machine: self,
+			err:     "loop in the jump hosts of self: self -> self",
+		},
+	}
+
+	core := New("", nil, nil, logrus.StandardLogger(), &mockTranslator{}, nil)
+	core.session.machines.set([]backend.Machine{bastion, relay, db, hidden, ping, pong, self})
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			chain, err := core.JumpChain(tc.machine)
+			if tc.err != "" {
+				assert.EqualError(err, tc.err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expected, chain)
+		})
+	}
+}
+
+func TestAccount(t *testing.T) {
+	assert := require.New(t)
+
+	core := New("secure", nil, nil, logrus.StandardLogger(), &mockTranslator{}, nil)
+
+	assert.Equal("dba", core.Account(backend.Machine{Account: "dba"}))
+	assert.Equal("secure", core.Account(backend.Machine{}))
+}
@@ -3,15 +3,30 @@ package database
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
 )
 
 const (
-	usersBucketName = "users" // Name of the bucket where all users are stored
+	usersBucketName      = "users"      // Name of the bucket where all users are stored
+	hostKeysBucketName   = "hostkeys"   // Name of the bucket where pinned host keys are stored
+	recordingsBucketName = "recordings" // Name of the bucket where session recordings are indexed
+	metaBucketName       = "meta"       // Name of the bucket where the database metadata are stored
+	rotationsBucketName  = "rotations"  // Name of the bucket where unfinished SSH key rotations are stored
+	ephemeralBucketName  = "ephemeral"  // Name of the bucket where the SSH keys of running sessions are stored
 )
 
+// schemaVersionKey is the key of the schema version in the meta bucket.
+const schemaVersionKey = "schemaVersion"
+
+// ErrNotFound is returned when the requested entry does not exist in the database.
+var ErrNotFound = errors.New("not found")
+
 // SecureGateBoltRepository is a database repository interacting
 // with a key/value embedded and lightweight database
 // called Bolt(Github: https://github.com/boltdb/bolt).
@@ -44,19 +59,89 @@ func (repo *SecureGateBoltRepository) OpenDatabase() error {
 
 	// Create the top-level buckets.
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(usersBucketName))
+		for _, name := range []string{usersBucketName, hostKeysBucketName, recordingsBucketName, metaBucketName, rotationsBucketName, ephemeralBucketName} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+
+		return migrate(tx)
+	})
+	if err != nil {
+		db.Close()
+		return errors.Wrap(err, "could not migrate the database")
+	}
+
+	repo.db = db
+
+	return nil
+}
+
+// migrations upgrade the stored data from one schema version to the next one.
+// The schema version of a database is the number of migrations applied to it,
+// so new migrations must only ever be appended.
+var migrations = []func(tx *bolt.Tx) error{
+	migrateMachinesSSHPort,
+}
+
+// migrate applies the migrations not yet applied to the database.
+func migrate(tx *bolt.Tx) error {
+	meta := tx.Bucket([]byte(metaBucketName))
+
+	var version int
+	if v := meta.Get([]byte(schemaVersionKey)); v != nil {
+		var err error
+		version, err = strconv.Atoi(string(v))
 		if err != nil {
-			return err
+			return errors.Wrap(err, "invalid schema version")
+		}
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("unknown schema version %d", version)
+	}
+
+	for ; version < len(migrations); version++ {
+		if err := migrations[version](tx); err != nil {
+			return errors.Wrapf(err, "migration to schema version %d failed", version+1)
 		}
+	}
+	return meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(version)))
+}
 
+// migrateMachinesSSHPort sets the SSH port of the stored machines, which
+// were used to be reached through their agent port, to the default one.
+func migrateMachinesSSHPort(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(usersBucketName))
+
+	users := make(map[string]User)
+	err := b.ForEach(func(k, v []byte) error {
+		var user User
+		if err := json.Unmarshal(v, &user); err != nil {
+			return err
+		}
+		users[string(k)] = user
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 
-	repo.db = db
-
+	// Keys can not be updated while iterating over the bucket.
+	for k, user := range users {
+		for i := range user.Machines {
+			if user.Machines[i].SSHPort == 0 {
+				user.Machines[i].SSHPort = defaultSSHPort
+			}
+		}
+		userBytes, err := json.Marshal(&user)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(k), userBytes); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -72,12 +157,20 @@ type User struct {
 	Machines []Machine `json:"machines"`
 }
 
+// defaultSSHPort is the SSH port of the machines stored before it was provided.
+const defaultSSHPort = 22
+
 // Machine is the machine model stored in the database.
 type Machine struct {
 	ID        string `json:"id"`
 	Name      string `json:"name"`
 	IP        string `json:"ip"`
 	AgentPort int    `json:"agentPort"`
+	SSHPort   int    `json:"sshPort"`
+	// Remote account of the user, the gate default one if empty
+	Account string `json:"account"`
+	// Scheme of the agent API, the configured one if empty
+	AgentScheme string `json:"agentScheme"`
 }
 
 // UpsertUser updates the user in the database or insert it if it
@@ -126,3 +219,260 @@ func (repo *SecureGateBoltRepository) GetUser(userID string) (User, error) {
 
 	return user, nil
 }
+
+// HostKey is the SSH host key pinned for a machine.
+type HostKey struct {
+	MachineID string    `json:"machineId"`
+	Key       string    `json:"key"`     // authorized_keys format
+	Pending   string    `json:"pending"` // key presented after a mismatch, waiting for approval
+	Source    string    `json:"source"`  // "tofu" or "backend"
+	FirstSeen time.Time `json:"firstSeen"`
+}
+
+// UpsertHostKey updates the host key of a machine in the database
+// or insert it if it do not exists already.
+func (repo *SecureGateBoltRepository) UpsertHostKey(hostKey HostKey) error {
+	// Struct values in the database are stored as JSON.
+	b, err := json.Marshal(&hostKey)
+	if err != nil {
+		return err
+	}
+
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(hostKeysBucketName)).Put([]byte(hostKey.MachineID), b)
+	})
+}
+
+// GetHostKey retrieves the host key pinned for the given machineID.
+// It returns ErrNotFound if no key is pinned for this machine.
+func (repo *SecureGateBoltRepository) GetHostKey(machineID string) (HostKey, error) {
+	var hostKey HostKey
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(hostKeysBucketName)).Get([]byte(machineID))
+		if v == nil {
+			return ErrNotFound
+		}
+
+		// Struct values in the database are stored as JSON.
+		return json.Unmarshal(v, &hostKey)
+	})
+	if err != nil {
+		return HostKey{}, err
+	}
+
+	return hostKey, nil
+}
+
+// DeleteHostKey removes the host key pinned for the given machineID.
+func (repo *SecureGateBoltRepository) DeleteHostKey(machineID string) error {
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(hostKeysBucketName)).Delete([]byte(machineID))
+	})
+}
+
+// HostKeys retrieves every pinned host key in the database.
+func (repo *SecureGateBoltRepository) HostKeys() ([]HostKey, error) {
+	var hostKeys []HostKey
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(hostKeysBucketName)).ForEach(func(k, v []byte) error {
+			var hostKey HostKey
+			if err := json.Unmarshal(v, &hostKey); err != nil {
+				return err
+			}
+			hostKeys = append(hostKeys, hostKey)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hostKeys, nil
+}
+
+// Recording is the index entry of a recorded session stored in the database.
+type Recording struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	MachineID string    `json:"machineId"`
+	Account   string    `json:"account"` // remote account of the session
+	Start     time.Time `json:"start"`
+	Path      string    `json:"path"` // location of the asciicast file
+}
+
+// AddRecording indexes the recording in the database.
+func (repo *SecureGateBoltRepository) AddRecording(recording Recording) error {
+	// Struct values in the database are stored as JSON.
+	b, err := json.Marshal(&recording)
+	if err != nil {
+		return err
+	}
+
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(recordingsBucketName)).Put([]byte(recording.ID), b)
+	})
+}
+
+// GetRecording retrieves the recording with the given ID.
+// It returns ErrNotFound if no recording owns this ID.
+func (repo *SecureGateBoltRepository) GetRecording(id string) (Recording, error) {
+	var recording Recording
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(recordingsBucketName)).Get([]byte(id))
+		if v == nil {
+			return ErrNotFound
+		}
+
+		// Struct values in the database are stored as JSON.
+		return json.Unmarshal(v, &recording)
+	})
+	if err != nil {
+		return Recording{}, err
+	}
+
+	return recording, nil
+}
+
+// Recordings retrieves the recordings of the given user on the given machine
+// sorted by start time. An empty userID or machineID matches every user or machine.
+func (repo *SecureGateBoltRepository) Recordings(userID, machineID string) ([]Recording, error) {
+	var recordings []Recording
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(recordingsBucketName)).ForEach(func(k, v []byte) error {
+			var recording Recording
+			if err := json.Unmarshal(v, &recording); err != nil {
+				return err
+			}
+			if userID != "" && recording.UserID != userID {
+				return nil
+			}
+			if machineID != "" && recording.MachineID != machineID {
+				return nil
+			}
+			recordings = append(recordings, recording)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Start.Before(recordings[j].Start)
+	})
+
+	return recordings, nil
+}
+
+// KeyRotation is the state of an unfinished rotation of the SSH key of a user.
+// The new key is used once registered in the agents of every machine
+// the user has access to, then the old key is unregistered from them.
+type KeyRotation struct {
+	UserID  string    `json:"userId"`
+	Started time.Time `json:"started"`
+	// Machines which confirmed the registration of the new key
+	Registered []Machine `json:"registered"`
+	// Replaced public key in authorized_keys format, set once the new key is used
+	OldKey string `json:"oldKey"`
+	// Machines from which the old key remains to be unregistered
+	Unregister []Machine `json:"unregister"`
+}
+
+// UpsertKeyRotation updates the key rotation of a user in the database
+// or insert it if it do not exists already.
+func (repo *SecureGateBoltRepository) UpsertKeyRotation(rotation KeyRotation) error {
+	// Struct values in the database are stored as JSON.
+	b, err := json.Marshal(&rotation)
+	if err != nil {
+		return err
+	}
+
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(rotationsBucketName)).Put([]byte(rotation.UserID), b)
+	})
+}
+
+// GetKeyRotation retrieves the unfinished key rotation of the given user.
+// It returns ErrNotFound if no rotation is in progress.
+func (repo *SecureGateBoltRepository) GetKeyRotation(userID string) (KeyRotation, error) {
+	var rotation KeyRotation
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(rotationsBucketName)).Get([]byte(userID))
+		if v == nil {
+			return ErrNotFound
+		}
+
+		// Struct values in the database are stored as JSON.
+		return json.Unmarshal(v, &rotation)
+	})
+	if err != nil {
+		return KeyRotation{}, err
+	}
+
+	return rotation, nil
+}
+
+// DeleteKeyRotation removes the key rotation of the given user once finished.
+func (repo *SecureGateBoltRepository) DeleteKeyRotation(userID string) error {
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(rotationsBucketName)).Delete([]byte(userID))
+	})
+}
+
+// EphemeralKey is an SSH key generated for a single session of a user,
+// revoked from the agents when the session ends.
+type EphemeralKey struct {
+	// Name of the key pair in the key store
+	Name   string `json:"name"`
+	UserID string `json:"userId"`
+	// Public key in authorized_keys format
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// UpsertEphemeralKey updates the ephemeral key in the database
+// or insert it if it do not exists already.
+func (repo *SecureGateBoltRepository) UpsertEphemeralKey(key EphemeralKey) error {
+	// Struct values in the database are stored as JSON.
+	b, err := json.Marshal(&key)
+	if err != nil {
+		return err
+	}
+
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(ephemeralBucketName)).Put([]byte(key.Name), b)
+	})
+}
+
+// EphemeralKeys retrieves the ephemeral keys not revoked yet.
+func (repo *SecureGateBoltRepository) EphemeralKeys() ([]EphemeralKey, error) {
+	var keys []EphemeralKey
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(ephemeralBucketName)).ForEach(func(k, v []byte) error {
+			var key EphemeralKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// DeleteEphemeralKey removes the ephemeral key once revoked.
+func (repo *SecureGateBoltRepository) DeleteEphemeralKey(name string) error {
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(ephemeralBucketName)).Delete([]byte(name))
+	})
+}
@@ -0,0 +1,335 @@
+// Package recording records terminal sessions in asciicast v2 format
+// (https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md)
+// and plays them back.
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Version of the asciicast format written by the Recorder.
+const Version = 2
+
+// Event types of an asciicast v2 file.
+const (
+	EventOutput = "o" // data printed to the terminal
+	EventInput  = "i" // data typed by the user
+	EventResize = "r" // terminal resized to "<width>x<height>"
+)
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes timestamped terminal events in asciicast v2 format.
+// It is safe for concurrent use.
+type Recorder struct {
+	// contains filtered or unexported fields
+	mu      sync.Mutex
+	enc     *json.Encoder
+	start   time.Time
+	pending map[string][]byte // incomplete UTF-8 sequences per event type
+}
+
+// NewRecorder writes the header to w and returns a Recorder
+// writing every following event to w.
+// The header version and timestamp are set by the recorder.
+func NewRecorder(w io.Writer, header Header) (*Recorder, error) {
+	start := time.Now()
+	header.Version = Version
+	header.Timestamp = start.Unix()
+
+	enc := json.NewEncoder(w)
+	// Keep the terminal output readable in the file.
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(&header); err != nil {
+		return nil, errors.Wrap(err, "could not write asciicast header")
+	}
+
+	return &Recorder{
+		enc:     enc,
+		start:   start,
+		pending: make(map[string][]byte),
+	}, nil
+}
+
+// Write records p as terminal output.
+func (r *Recorder) Write(p []byte) (int, error) {
+	if err := r.record(EventOutput, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Input returns a writer recording everything written to it as user input.
+func (r *Recorder) Input() io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		if err := r.record(EventInput, p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+// Resize records a change of the terminal size.
+func (r *Recorder) Resize(width, height int) error {
+	return r.record(EventResize, []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+// Close records the remaining bytes of incomplete multi-byte characters.
+// The underlying writer is not closed.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elapsed := time.Since(r.start).Seconds()
+	for _, typ := range []string{EventOutput, EventInput} {
+		if len(r.pending[typ]) == 0 {
+			continue
+		}
+		if err := r.enc.Encode([]interface{}{elapsed, typ, marshalData(r.pending[typ])}); err != nil {
+			return err
+		}
+		delete(r.pending, typ)
+	}
+	return nil
+}
+
+// record writes an event of the given type with the elapsed time since
+// the start of the recording. Multi-byte characters split between two
+// writes are kept until they are complete so they stay readable in the file.
+func (r *Recorder) record(typ string, p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.pending[typ], p...)
+	n := completeUTF8(data)
+	r.pending[typ] = append([]byte(nil), data[n:]...)
+	if n == 0 {
+		return nil
+	}
+
+	elapsed := time.Since(r.start).Seconds()
+	return r.enc.Encode([]interface{}{elapsed, typ, marshalData(data[:n])})
+}
+
+// marshalData returns the JSON string of the event data p. The bytes of p
+// which are not valid UTF-8 are escaped as the lone surrogates U+DC80 to
+// U+DCFF, like Python's "surrogateescape", so the data is played back
+// byte-exact by Play while other players only show replacement characters.
+func marshalData(p []byte) json.RawMessage {
+	const hex = "0123456789abcdef"
+
+	b := make([]byte, 0, len(p)+2)
+	b = append(b, '"')
+	for i := 0; i < len(p); {
+		r, size := utf8.DecodeRune(p[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b = append(b, '\\', 'u', 'd', 'c', hex[p[i]>>4], hex[p[i]&0xf])
+		case r == '"' || r == '\\':
+			b = append(b, '\\', byte(r))
+		case r == '\n':
+			b = append(b, '\\', 'n')
+		case r == '\r':
+			b = append(b, '\\', 'r')
+		case r == '\t':
+			b = append(b, '\\', 't')
+		case r < 0x20:
+			b = append(b, '\\', 'u', '0', '0', hex[r>>4], hex[r&0xf])
+		default:
+			b = append(b, p[i:i+size]...)
+		}
+		i += size
+	}
+	return append(b, '"')
+}
+
+// unmarshalData returns the event data of the JSON string raw,
+// restoring the bytes escaped by marshalData.
+func unmarshalData(raw json.RawMessage) ([]byte, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(raw, []byte(`\u`)) {
+		return []byte(s), nil
+	}
+
+	raw = raw[1 : len(raw)-1]
+	data := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); {
+		if raw[i] != '\\' {
+			data = append(data, raw[i])
+			i++
+			continue
+		}
+		switch c := raw[i+1]; c {
+		case 'b':
+			data = append(data, '\b')
+		case 'f':
+			data = append(data, '\f')
+		case 'n':
+			data = append(data, '\n')
+		case 'r':
+			data = append(data, '\r')
+		case 't':
+			data = append(data, '\t')
+		case 'u':
+			r := unhex(raw[i+2 : i+6])
+			switch {
+			case r >= 0xdc80 && r <= 0xdcff:
+				data = append(data, byte(r-0xdc00))
+			case utf16.IsSurrogate(r) && i+12 <= len(raw) && raw[i+6] == '\\' && raw[i+7] == 'u':
+				if pair := utf16.DecodeRune(r, unhex(raw[i+8:i+12])); pair != utf8.RuneError {
+					r = pair
+					i += 6
+				}
+				fallthrough
+			default:
+				data = append(data, string(r)...)
+			}
+			i += 4
+		default:
+			data = append(data, c)
+		}
+		i += 2
+	}
+	return data, nil
+}
+
+// unhex returns the rune of the 4 hexadecimal digits of a \u escape.
+func unhex(p []byte) rune {
+	var r rune
+	for _, c := range p {
+		r <<= 4
+		switch {
+		case c >= '0' && c <= '9':
+			r |= rune(c - '0')
+		case c >= 'a' && c <= 'f':
+			r |= rune(c - 'a' + 10)
+		case c >= 'A' && c <= 'F':
+			r |= rune(c - 'A' + 10)
+		}
+	}
+	return r
+}
+
+// completeUTF8 returns the length of the longest prefix of p
+// which does not end with an incomplete UTF-8 sequence.
+func completeUTF8(p []byte) int {
+	// A UTF-8 sequence is at most utf8.UTFMax bytes long.
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		c := p[len(p)-i]
+		if c < utf8.RuneSelf {
+			return len(p)
+		}
+		if utf8.RuneStart(c) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return len(p)
+			}
+			return len(p) - i
+		}
+	}
+	return len(p)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// Play reads an asciicast v2 recording from r and writes its output events
+// to w respecting their timing. speed divides the delays between events
+// and maxIdle, when positive, caps them. Play stops when ctx is done.
+func Play(ctx context.Context, r io.Reader, w io.Writer, speed float64, maxIdle time.Duration) error {
+	if speed <= 0 {
+		return fmt.Errorf("invalid speed: %v", speed)
+	}
+
+	scanner := bufio.NewScanner(r)
+	// Output events can be large when a lot is printed at once.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return errors.Wrap(err, "could not read asciicast header")
+		}
+		return errors.New("empty recording")
+	}
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return errors.Wrap(err, "could not parse asciicast header")
+	}
+	if header.Version != Version {
+		return fmt.Errorf("unsupported asciicast version: %d", header.Version)
+	}
+
+	var last float64
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var event []json.RawMessage
+		if err := json.Unmarshal(line, &event); err != nil {
+			return errors.Wrap(err, "could not parse asciicast event")
+		}
+		if len(event) != 3 {
+			return fmt.Errorf("invalid asciicast event: %s", line)
+		}
+		var (
+			at  float64
+			typ string
+		)
+		err := json.Unmarshal(event[0], &at)
+		if err == nil {
+			err = json.Unmarshal(event[1], &typ)
+		}
+		var data []byte
+		if err == nil {
+			data, err = unmarshalData(event[2])
+		}
+		if err != nil {
+			return fmt.Errorf("invalid asciicast event: %s", line)
+		}
+
+		delay := time.Duration((at - last) / speed * float64(time.Second))
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		last = at
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		if typ != EventOutput {
+			continue
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,134 @@
+package recording
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	assert := require.New(t)
+
+	var buf bytes.Buffer
+	recorder, err := NewRecorder(&buf, Header{Width: 80, Height: 24})
+	assert.NoError(err)
+
+	// "é" is split between two writes.
+	_, err = recorder.Write([]byte("caf\xc3"))
+	assert.NoError(err)
+	_, err = recorder.Write([]byte("\xa9\r\n\x1b[0m"))
+	assert.NoError(err)
+	assert.NoError(recorder.Resize(120, 40))
+	_, err = recorder.Input().Write([]byte("ls\r"))
+	assert.NoError(err)
+	assert.NoError(recorder.Close())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(lines, 5)
+
+	var header Header
+	assert.NoError(json.Unmarshal([]byte(lines[0]), &header))
+	assert.Equal(Version, header.Version)
+	assert.Equal(80, header.Width)
+	assert.Equal(24, header.Height)
+	assert.NotZero(header.Timestamp)
+
+	expected := [][2]string{
+		{EventOutput, "caf"},
+		{EventOutput, "é\r\n\x1b[0m"},
+		{EventResize, "120x40"},
+		{EventInput, "ls\r"},
+	}
+	for i, e := range expected {
+		var event []interface{}
+		assert.NoError(json.Unmarshal([]byte(lines[i+1]), &event))
+		assert.Len(event, 3)
+		assert.Equal(e[0], event[1])
+		assert.Equal(e[1], event[2])
+	}
+}
+
+func TestRecorderByteExact(t *testing.T) {
+	assert := require.New(t)
+
+	var buf bytes.Buffer
+	recorder, err := NewRecorder(&buf, Header{Width: 80, Height: 24})
+	assert.NoError(err)
+
+	// Invalid UTF-8, control characters, non-BMP and replacement characters
+	data := []byte("\xff\xfe\x00\x1b[1m\"quoted\" \\ \U0001F600 \uFFFD\xc3")
+	_, err = recorder.Write(data)
+	assert.NoError(err)
+	assert.NoError(recorder.Close())
+
+	var out bytes.Buffer
+	assert.NoError(Play(context.Background(), &buf, &out, 1000, time.Millisecond))
+	assert.Equal(data, out.Bytes())
+}
+
+func TestPlay(t *testing.T) {
+	assert := require.New(t)
+
+	tt := []struct {
+		name      string
+		recording string
+		speed     float64
+		expected  string
+		err       string
+	}{
+		{
+			name: "valid recording",
+			recording: `{"version": 2, "width": 80, "height": 24}
+[0.1, "o", "hello "]
+[0.2, "i", "ignored"]
+[0.3, "o", "world\r\n"]
+`,
+			speed:    10,
+			expected: "hello world\r\n",
+		},
+		{
+			name: "escaped bytes",
+			recording: `{"version": 2, "width": 80, "height": 24}
+[0.1, "o", "\udcff\u00e9\ud83d\ude00"]
+`,
+			speed:    10,
+			expected: "\xffé\U0001F600",
+		},
+		{
+			name:      "unsupported version",
+			recording: `{"version": 1, "width": 80, "height": 24}`,
+			speed:     1,
+			err:       "unsupported asciicast version: 1",
+		},
+		{
+			name:      "invalid speed",
+			recording: `{"version": 2, "width": 80, "height": 24}`,
+			speed:     0,
+			err:       "invalid speed: 0",
+		},
+		{
+			name:      "empty recording",
+			recording: "",
+			speed:     1,
+			err:       "empty recording",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Play(context.Background(), strings.NewReader(tc.recording), &out, tc.speed, time.Second)
+			if tc.err != "" {
+				assert.EqualError(err, tc.err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expected, out.String())
+		})
+	}
+}
@@ -19,16 +19,10 @@ type SecureGatePrompt struct {
 
 // makeConnectCommandCompleter returns a function which is used
 // to make dynamic completion on connect command with accessible nodes
-// of the current user.
+// of the current user. Nodes sharing their name are completed by ID.
 func makeConnectCommandCompleter(core *core.SecureGateCore) readline.DynamicCompleteFunc {
 	return func(line string) []string {
-		var machineNames []string
-
-		for _, m := range core.Machines() {
-			machineNames = append(machineNames, m.Name)
-		}
-
-		return machineNames
+		return core.MachineReferences()
 	}
 }
 
@@ -39,7 +33,37 @@ func NewSecureGatePrompt(in io.ReadCloser, core *core.SecureGateCore) (*SecureGa
 		readline.PcItem("connect",
 			readline.PcItemDynamic(makeConnectCommandCompleter(core)),
 		),
+		readline.PcItem("exec",
+			readline.PcItemDynamic(makeConnectCommandCompleter(core)),
+		),
+		readline.PcItem("pexec",
+			readline.PcItem("--all"),
+			readline.PcItem("--glob"),
+			readline.PcItem("--ids"),
+		),
+		readline.PcItem("put",
+			readline.PcItemDynamic(makeConnectCommandCompleter(core)),
+		),
+		readline.PcItem("get",
+			readline.PcItemDynamic(makeConnectCommandCompleter(core)),
+		),
+		readline.PcItem("forward",
+			readline.PcItemDynamic(makeConnectCommandCompleter(core)),
+		),
+		readline.PcItem("hostkeys",
+			readline.PcItem("list"),
+			readline.PcItem("approve",
+				readline.PcItemDynamic(makeConnectCommandCompleter(core)),
+			),
+			readline.PcItem("forget",
+				readline.PcItemDynamic(makeConnectCommandCompleter(core)),
+			),
+		),
+		readline.PcItem("keys",
+			readline.PcItem("rotate"),
+		),
 		readline.PcItem("list"),
+		readline.PcItem("replay"),
 		readline.PcItem("me"),
 		readline.PcItem("logout"),
 		readline.PcItem("exit"),
@@ -77,7 +77,7 @@ mainLoop:
 			// Log the input in log file if one exists.
 			sh.Core.Logger.WithFields(logrus.Fields{
 				"user": user.ID,
-			}).Warnf("%s\n", cmd)
+			}).Warnf("%s\n", sh.Core.Redactor.Redact(cmd))
 
 			// Executes the command line.
 			err = sh.Command.Execute(cmd)